@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+)
+
+// Scopes of API keys. No route requires ScopeAdmin itself, it is a superset of the other scopes: admin keys can do
+// everything they allow, including scopes added later.
+const (
+	ScopeBroadcast  = "broadcast"
+	ScopeReadStatus = "read-status"
+	ScopeAdmin      = "admin"
+)
+
+var apiKeyScopes = []string{ScopeBroadcast, ScopeReadStatus, ScopeAdmin}
+
+// apiKeyPrefix starts every API key, so leaked keys are easy to recognise.
+const apiKeyPrefix = "rwis_"
+
+// apiKeyLookupLength is how much of the random part of a key is stored in plain text to find it.
+const apiKeyLookupLength = 8
+
+// ApiKey is a named key clients of the API authenticate with. Only a hash of the key is stored.
+type ApiKey struct {
+	Id        int
+	Name      string
+	Scopes    []string
+	ExpiresAt *time.Time
+	RevokedAt *time.Time
+	CreatedAt time.Time
+}
+
+// Allows reports whether the key grants the scope.
+func (k ApiKey) Allows(scope string) bool {
+	for _, granted := range k.Scopes {
+		if granted == scope || granted == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// Active reports whether the key can still be used.
+func (k ApiKey) Active() bool {
+	return k.RevokedAt == nil && (k.ExpiresAt == nil || k.ExpiresAt.After(time.Now()))
+}
+
+func hashApiKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+// apiKeyLookup returns the part of the key stored in plain text, or an empty string when it is not an API key.
+func apiKeyLookup(key string) string {
+	if !strings.HasPrefix(key, apiKeyPrefix) || len(key) < len(apiKeyPrefix)+apiKeyLookupLength {
+		return ""
+	}
+	return key[len(apiKeyPrefix) : len(apiKeyPrefix)+apiKeyLookupLength]
+}
+
+// createApiKey stores a new key and returns it. The key can not be retrieved again afterwards.
+func createApiKey(ctx context.Context, db *pgxpool.Pool, name string, scopes []string, expiresAt *time.Time) (string, error) {
+	if strings.TrimSpace(name) == "" {
+		return "", errors.New("name is required")
+	}
+	if len(scopes) == 0 {
+		return "", errors.New("at least one scope is required")
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(apiKeyScopes, scope) {
+			return "", errors.Errorf("unknown scope %q, must be one of %s", scope, strings.Join(apiKeyScopes, ", "))
+		}
+	}
+
+	random := make([]byte, 24)
+	_, err := rand.Read(random)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to generate key")
+	}
+	key := apiKeyPrefix + hex.EncodeToString(random)
+
+	_, err = db.Exec(ctx, `
+INSERT INTO api_key (name, lookup, key_hash, scopes, expires_at)
+VALUES ($1, $2, $3, $4, $5)`, name, apiKeyLookup(key), hashApiKey(key), scopes, expiresAt)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to insert api key")
+	}
+	return key, nil
+}
+
+// revokeApiKey revokes the key with the given name. It returns false when there is no such active key.
+func revokeApiKey(ctx context.Context, db *pgxpool.Pool, name string) (bool, error) {
+	tag, err := db.Exec(ctx, `
+UPDATE api_key
+SET revoked_at = now()
+WHERE name = $1
+  AND revoked_at IS NULL`, name)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to revoke api key")
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// authenticateApiKey returns the active key matching the given key, or nil when there is none. Hashes are compared in
+// constant time.
+func authenticateApiKey(ctx context.Context, db *pgxpool.Pool, key string) (*ApiKey, error) {
+	lookup := apiKeyLookup(key)
+	if lookup == "" {
+		return nil, nil
+	}
+
+	rows, err := db.Query(ctx, `
+SELECT api_key_id, name, scopes, expires_at, revoked_at, created_at, key_hash
+FROM api_key
+WHERE lookup = $1`, lookup)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get api keys")
+	}
+	defer rows.Close()
+
+	hash := []byte(hashApiKey(key))
+	var found *ApiKey
+	for rows.Next() {
+		var apiKey ApiKey
+		var keyHash string
+		err := rows.Scan(&apiKey.Id, &apiKey.Name, &apiKey.Scopes, &apiKey.ExpiresAt, &apiKey.RevokedAt, &apiKey.CreatedAt, &keyHash)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to scan api key")
+		}
+		if subtle.ConstantTimeCompare(hash, []byte(keyHash)) == 1 && apiKey.Active() {
+			found = &apiKey
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to read api keys")
+	}
+	return found, nil
+}
+
+// listApiKeys returns every key, the newest first.
+func listApiKeys(ctx context.Context, db *pgxpool.Pool) ([]ApiKey, error) {
+	rows, err := db.Query(ctx, `
+SELECT api_key_id, name, scopes, expires_at, revoked_at, created_at
+FROM api_key
+ORDER BY created_at DESC`)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get api keys")
+	}
+	keys, err := pgx.CollectRows(rows, pgx.RowToStructByPos[ApiKey])
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to scan api keys")
+	}
+	return keys, nil
+}
+
+// apiKeyCommand manages the keys clients of the API authenticate with.
+func apiKeyCommand() *cli.Command {
+	withDatabase := func(action func(ctx context.Context, c *cli.Context, db *pgxpool.Pool) error) cli.ActionFunc {
+		return func(c *cli.Context) error {
+			ctx, cancel := context.WithTimeout(c.Context, 10*time.Second)
+			defer cancel()
+			db, err := openDatabase(ctx)
+			if err != nil {
+				return err
+			}
+			defer db.Close()
+			return action(ctx, c, db)
+		}
+	}
+
+	return &cli.Command{
+		Name:  "apikey",
+		Usage: "Manage API keys",
+		Subcommands: []*cli.Command{
+			{
+				Name:  "create",
+				Usage: "Create an API key and print it",
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: "name", Usage: "name of the key, recorded on request logs", Required: true},
+					&cli.StringSliceFlag{Name: "scope", Usage: "scope of the key: " + strings.Join(apiKeyScopes, ", ") + ", admin grants all of them", Required: true},
+					&cli.DurationFlag{Name: "expires-in", Usage: "time until the key expires, e.g. 720h, or 0 to never expire"},
+				},
+				Action: withDatabase(func(ctx context.Context, c *cli.Context, db *pgxpool.Pool) error {
+					var expiresAt *time.Time
+					if expiresIn := c.Duration("expires-in"); expiresIn > 0 {
+						expiry := time.Now().Add(expiresIn)
+						expiresAt = &expiry
+					}
+					key, err := createApiKey(ctx, db, c.String("name"), c.StringSlice("scope"), expiresAt)
+					if err != nil {
+						return err
+					}
+					fmt.Fprintln(os.Stderr, "Store this key now, it can not be shown again:")
+					fmt.Println(key)
+					return nil
+				}),
+			},
+			{
+				Name:  "revoke",
+				Usage: "Revoke an API key",
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: "name", Usage: "name of the key", Required: true},
+				},
+				Action: withDatabase(func(ctx context.Context, c *cli.Context, db *pgxpool.Pool) error {
+					revoked, err := revokeApiKey(ctx, db, c.String("name"))
+					if err != nil {
+						return err
+					}
+					if !revoked {
+						return errors.Errorf("no active api key named %q", c.String("name"))
+					}
+					fmt.Printf("Revoked api key %s\n", c.String("name"))
+					return nil
+				}),
+			},
+			{
+				Name:  "list",
+				Usage: "List API keys",
+				Action: withDatabase(func(ctx context.Context, c *cli.Context, db *pgxpool.Pool) error {
+					keys, err := listApiKeys(ctx, db)
+					if err != nil {
+						return err
+					}
+					for _, key := range keys {
+						status := "active"
+						if key.RevokedAt != nil {
+							status = "revoked " + key.RevokedAt.Format(time.RFC3339)
+						} else if !key.Active() {
+							status = "expired " + key.ExpiresAt.Format(time.RFC3339)
+						} else if key.ExpiresAt != nil {
+							status = "expires " + key.ExpiresAt.Format(time.RFC3339)
+						}
+						fmt.Printf("%s\t%s\t%s\n", key.Name, strings.Join(key.Scopes, ","), status)
+					}
+					return nil
+				}),
+			},
+		},
+	}
+}
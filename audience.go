@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pkg/errors"
+)
+
+// AudienceFilter selects broadcast recipients by resident attributes, such as "every head of household in RT 02" or
+// "residents aged 60 and above". Every field is optional and all given fields must match.
+type AudienceFilter struct {
+	// RT and RW match the RT or RW number of the resident's household.
+	RT []int `json:"rt"`
+	RW []int `json:"rw"`
+	// Gender matches the gender of the resident, ignoring case.
+	Gender string `json:"gender"`
+	// MinAge and MaxAge are inclusive, computed from the resident's date of birth.
+	MinAge *int `json:"min_age"`
+	MaxAge *int `json:"max_age"`
+	// HeadOfHousehold selects only heads of household when true, or only other members when false.
+	HeadOfHousehold *bool `json:"head_of_household"`
+	// Roles selects residents registered as officials with one of the roles, OfficialRoleRT or OfficialRoleRW.
+	Roles []string `json:"roles"`
+}
+
+// Validate checks the values of the filter.
+func (f AudienceFilter) Validate() error {
+	if f.MinAge != nil && *f.MinAge < 0 {
+		return errors.New("audience min_age must not be negative")
+	}
+	if f.MaxAge != nil && *f.MaxAge < 0 {
+		return errors.New("audience max_age must not be negative")
+	}
+	if f.MinAge != nil && f.MaxAge != nil && *f.MinAge > *f.MaxAge {
+		return errors.New("audience min_age must not be greater than max_age")
+	}
+	for _, role := range f.Roles {
+		if role != OfficialRoleRT && role != OfficialRoleRW {
+			return errors.Errorf("unknown audience role %q", role)
+		}
+	}
+	return nil
+}
+
+// query builds the query selecting the whatsapp numbers of the residents matching the filter.
+func (f AudienceFilter) query() (string, []any) {
+	var conditions []string
+	var args []any
+	arg := func(value any) string {
+		args = append(args, value)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	conditions = append(conditions, "coalesce(r.whatsapp_number, '') <> ''")
+	if len(f.RT) > 0 {
+		conditions = append(conditions, "NULLIF(regexp_replace(h.rt, '\\D', '', 'g'), '')::int = ANY("+arg(f.RT)+")")
+	}
+	if len(f.RW) > 0 {
+		conditions = append(conditions, "NULLIF(regexp_replace(h.rw, '\\D', '', 'g'), '')::int = ANY("+arg(f.RW)+")")
+	}
+	if f.Gender != "" {
+		conditions = append(conditions, "lower(r.gender) = lower("+arg(f.Gender)+")")
+	}
+	if f.MinAge != nil {
+		conditions = append(conditions, "r.date_of_birth <= current_date - make_interval(years => "+arg(*f.MinAge)+")")
+	}
+	if f.MaxAge != nil {
+		// younger than max_age + 1 years, so residents who are exactly max_age are included
+		conditions = append(conditions, "r.date_of_birth > current_date - make_interval(years => "+arg(*f.MaxAge+1)+")")
+	}
+	if f.HeadOfHousehold != nil {
+		if *f.HeadOfHousehold {
+			conditions = append(conditions, "h.resident_id = r.resident_id")
+		} else {
+			conditions = append(conditions, "h.resident_id IS DISTINCT FROM r.resident_id")
+		}
+	}
+	if len(f.Roles) > 0 {
+		conditions = append(conditions, "r.whatsapp_number IN (SELECT whatsapp_number FROM official WHERE role = ANY("+arg(f.Roles)+"))")
+	}
+
+	return `
+SELECT DISTINCT r.whatsapp_number
+FROM resident r
+LEFT JOIN household h on r.household_id = h.household_id
+WHERE ` + strings.Join(conditions, "\n  AND "), args
+}
+
+// resolveAudience returns the whatsapp numbers of the residents matching the filter.
+func resolveAudience(ctx context.Context, db *pgxpool.Pool, filter AudienceFilter) ([]string, error) {
+	query, args := filter.query()
+	rows, err := db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get audience")
+	}
+	numbers, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to scan audience")
+	}
+	return numbers, nil
+}
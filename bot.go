@@ -16,15 +16,18 @@ import (
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
 	"go.mau.fi/whatsmeow"
-	waProto "go.mau.fi/whatsmeow/binary/proto"
 	"go.mau.fi/whatsmeow/types/events"
-	"google.golang.org/protobuf/proto"
 )
 
 type Bot struct {
-	client *whatsmeow.Client
-	cache  *bigcache.BigCache
-	db     *pgxpool.Pool
+	client        *whatsmeow.Client
+	outbox        *Outbox
+	cache         *bigcache.BigCache
+	db            *pgxpool.Pool
+	conversations *ConversationStore
+	media         MediaStore
+	transcriber   Transcriber
+	similarity    IssueSimilarity
 }
 
 func (b *Bot) RegisterHandlers() {
@@ -72,11 +75,8 @@ func (b *Bot) handlePingEvent(evt *events.Message) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
 	defer cancel()
 	evt.Info.Sender.Device = 0
-	message, err := b.client.SendMessage(ctx, evt.Info.Sender, &waProto.Message{
-		ExtendedTextMessage: &waProto.ExtendedTextMessage{
-			Text: proto.String("Pong! Response Time: " + strconv.FormatInt(time.Since(startTime).Nanoseconds(), 10) + "ns"),
-		},
-	})
+	reply := "Pong! Response Time: " + strconv.FormatInt(time.Since(startTime).Nanoseconds(), 10) + "ns"
+	message, err := b.outbox.Send(ctx, evt.Info.Sender, newReplyMessage(reply, evt, shouldQuote("ping")), nil)
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to send message")
 	} else {
@@ -84,6 +84,43 @@ func (b *Bot) handlePingEvent(evt *events.Message) {
 	}
 }
 
+// handleVoiceNoteEvent transcribes a voice note. When it can not be transcribed, the resident is asked to type their
+// message instead and false is returned.
+func (b *Bot) handleVoiceNoteEvent(evt *events.Message) (string, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	evt.Info.Sender.Device = 0
+
+	transcript, err := b.transcribeVoiceNote(ctx, evt)
+	if err == nil {
+		return transcript, true
+	}
+
+	log.Error().Err(err).Msg("Failed to transcribe voice note")
+	err = b.sendReply(ctx, evt, "voice_note", "Maaf, Otra tidak dapat memahami pesan suara Anda. Silakan ketik pesan Anda.")
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to send message")
+	}
+	return "", false
+}
+
+// handleIssueStatusEvent replies with the status of the issue reports filed by the sender.
+func (b *Bot) handleIssueStatusEvent(sender string, evt *events.Message) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	evt.Info.Sender.Device = 0
+
+	err, reply := handleIssueStatusRequest(ctx, b.db, sender, 0)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to handle issue status request")
+		return
+	}
+	err = b.sendReply(ctx, evt, "issue_status_request", reply)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to send message")
+	}
+}
+
 func (b *Bot) handleGeminiEvent(sender string, msg string, evt *events.Message) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
 	defer cancel()
@@ -95,9 +132,26 @@ func (b *Bot) handleGeminiEvent(sender string, msg string, evt *events.Message)
 		log.Error().Err(err).Msg("Failed to get chat context")
 	}
 
+	// photos are downloaded once, for gemini to look at and to be attached to an issue report
+	var attachments []InlineData
+	var photo []byte
+	if image := evt.Message.GetImageMessage(); image != nil {
+		photo, err = b.downloadMedia(image)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to download image")
+		} else if inlineData, err := newInlineData(image.GetMimetype(), photo); err != nil {
+			log.Warn().Err(err).Msg("Image can not be sent to gemini, sending the caption only")
+		} else {
+			attachments = append(attachments, inlineData)
+		}
+		if msg == "" {
+			msg = "[foto]"
+		}
+	}
+
 	// fetch answer from gemini
 	question := fmt.Sprintf(`{ "sender": "%s", "chat": "%s" }`, evt.Info.Sender, msg)
-	geminiAnswer, err := fetchGeminiResponse(question, chatContext.Items)
+	geminiAnswer, err := fetchGeminiResponse(question, chatContext.Items, attachments...)
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to fetch response from gemini")
 		geminiAnswer = "Maaf, saya tidak bisa membantu Anda saat ini."
@@ -108,13 +162,18 @@ func (b *Bot) handleGeminiEvent(sender string, msg string, evt *events.Message)
 
 	// try parsing the answer to see if it's a command
 	var reply string
+	intent := "chat"
 	err, output := parseGeminiAnswer(geminiAnswer)
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to parse gemini answer. Falling back to default message.")
 		reply = geminiAnswer
 	} else {
+		if outputType, ok := output["type"].(string); ok {
+			intent = outputType
+		}
+
 		// handle different type of output accordingly
-		switch output["type"] {
+		switch intent {
 		case "personal_data_request":
 			log.Debug().Msgf("Handling personal data request from %s", sender)
 			err, reply = handlePersonalDataRequest(ctx, b.db, sender, output["include"].(string))
@@ -124,10 +183,21 @@ func (b *Bot) handleGeminiEvent(sender string, msg string, evt *events.Message)
 			}
 		case "issue_report":
 			log.Debug().Msgf("Handling issue report from %s", sender)
-			meta := output["meta"].(map[string]interface{})
-			err, reply = handleIssueReport(ctx, b.db, sender, output["value"].(string), meta["title"].(string), meta["description"].(string))
+			meta, _ := output["meta"].(map[string]interface{})
+			value, _ := output["value"].(string)
+			// the report is only written once every field is collected and the resident confirms it
+			draft := issueReportDraftFromMeta(value, meta)
+			draft.attachLocation(evt)
+			if len(photo) > 0 {
+				draft.setPhoto(photo, evt.Message.GetImageMessage().GetMimetype(), evt.Info.ID)
+			}
+			reply = b.startIssueReportForm(ctx, sender, draft)
+		case "issue_status_request":
+			log.Debug().Msgf("Handling issue status request from %s", sender)
+			ticket, _ := output["ticket"].(float64)
+			err, reply = handleIssueStatusRequest(ctx, b.db, sender, int(ticket))
 			if err != nil {
-				log.Error().Err(err).Msg("Failed to handle issue report")
+				log.Error().Err(err).Msg("Failed to handle issue status request")
 				return
 			}
 		case "chat":
@@ -137,16 +207,14 @@ func (b *Bot) handleGeminiEvent(sender string, msg string, evt *events.Message)
 		}
 	}
 
+	if sideEffectIntents[intent] && evt.Message.GetAudioMessage() != nil {
+		reply = echoTranscript(msg, reply)
+	}
+
 	log.Debug().Msgf("Sending reply to %s: %s", sender, reply)
-	message, err := b.client.SendMessage(ctx, evt.Info.Sender, &waProto.Message{
-		ExtendedTextMessage: &waProto.ExtendedTextMessage{
-			Text: proto.String(reply),
-		},
-	})
+	err = b.sendReply(ctx, evt, intent, reply)
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to send message")
-	} else {
-		log.Debug().Msgf("Sent message %+v", message)
 	}
 
 	// store to chat context unique to each user
@@ -165,25 +233,57 @@ func (b *Bot) handleGeminiEvent(sender string, msg string, evt *events.Message)
 func (b *Bot) messageHandler(evt interface{}) {
 	switch v := evt.(type) {
 	case *events.Message:
-		// ignore if it's from a group
-		if v.Info.IsGroup {
-			return
-		}
-
 		// whitelist the sender
 		senderNumber := strings.Split(v.Info.Sender.String(), "@")[0]
 		// if it's coming from whatsapp web, the number will be different, it will have a trailing code separated
 		// by a colon, so we need to split it again
 		senderNumber = strings.Split(senderNumber, ":")[0]
 
+		// ignore if it's from a group, except for officials acting on reports in the admin group
+		if v.Info.IsGroup {
+			if group, ok := adminGroup(); ok && v.Info.Chat == group {
+				b.handleAdminCommand(senderNumber, extractMessage(v), v)
+			}
+			return
+		}
+
 		msg := extractMessage(v)
+		// voice notes go through the same pipeline as text, using their transcript
+		if msg == "" && v.Message.GetAudioMessage() != nil {
+			var ok bool
+			msg, ok = b.handleVoiceNoteEvent(v)
+			if !ok {
+				return
+			}
+		}
 		if msg == "ping" {
 			b.handlePingEvent(v)
 			return
 		}
+		if b.handleAdminCommand(senderNumber, msg, v) {
+			return
+		}
+		// answers to a pending menu or question go back to the handler that asked, even when they look like a command,
+		// so an answer such as "stop" does not throw away a half filled form
+		if b.handleConversation(senderNumber, msg, v) {
+			return
+		}
+		if b.handleOptOutEvent(senderNumber, msg, v) {
+			return
+		}
+		if strings.EqualFold(strings.TrimSpace(msg), "menu") {
+			b.handleMenuEvent(senderNumber, v)
+			return
+		}
+		if strings.EqualFold(strings.TrimSpace(msg), "laporan") {
+			b.handleIssueStatusEvent(senderNumber, v)
+			return
+		}
 		// handle the rest of the messages using gemini
 		b.handleGeminiEvent(senderNumber, msg, v)
 		break
+	case *events.Receipt:
+		b.handleReceiptEvent(v)
 	}
 }
 
@@ -194,5 +294,17 @@ func extractMessage(v *events.Message) string {
 	if msg == "" {
 		msg = v.Message.GetExtendedTextMessage().GetText()
 	}
+	// images only carry text in their caption
+	if msg == "" {
+		msg = v.Message.GetImageMessage().GetCaption()
+	}
+	// describe location pins so gemini knows where the resident is talking about
+	if location := v.Message.GetLocationMessage(); msg == "" && location != nil {
+		msg = fmt.Sprintf("Lokasi: %s %s (%f, %f)",
+			location.GetName(),
+			location.GetAddress(),
+			location.GetDegreesLatitude(),
+			location.GetDegreesLongitude())
+	}
 	return msg
 }
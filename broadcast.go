@@ -0,0 +1,682 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"go.mau.fi/whatsmeow/types"
+)
+
+const (
+	// MaxBroadcastRecipients is the largest number of recipients a single broadcast job can have.
+	MaxBroadcastRecipients = 5000
+)
+
+const (
+	BroadcastStatusScheduled = "scheduled"
+	BroadcastStatusQueued    = "queued"
+	BroadcastStatusRunning   = "running"
+	BroadcastStatusFinished  = "finished"
+	BroadcastStatusCancelled = "cancelled"
+
+	RecipientStatusPending = "pending"
+	RecipientStatusSent    = "sent"
+	RecipientStatusFailed  = "failed"
+	// RecipientStatusOptedOut is a recipient who unsubscribed from the category of the broadcast.
+	RecipientStatusOptedOut = "opted_out"
+)
+
+// BroadcastRequest is the body of a broadcast submitted to the API. Recipients are given as a list of numbers, an
+// audience filter, or both.
+type BroadcastRequest struct {
+	Message    string          `json:"message"`
+	Recipients []string        `json:"recipients"`
+	Audience   *AudienceFilter `json:"audience"`
+	// DryRun only resolves the recipients and returns their count, without sending anything.
+	DryRun bool `json:"dry_run"`
+	// SendAt schedules the broadcast for a later time, e.g. "2024-06-01T06:00:00+07:00". It is sent right away when
+	// not given.
+	SendAt *time.Time `json:"send_at"`
+	// Media is an image or document sent with the message as its caption.
+	Media *BroadcastMedia `json:"media"`
+	// Category is one of BroadcastCategories, DefaultBroadcastCategory when not given. Residents who opted out of the
+	// category are skipped, unless it is mandatory.
+	Category string `json:"category"`
+	// Skipped are the numbers of residents matching the audience that are not valid whatsapp numbers.
+	Skipped []string `json:"-"`
+}
+
+// BroadcastJob is a broadcast along with the delivery status of each of its recipients.
+type BroadcastJob struct {
+	Id         int64                `json:"id"`
+	Message    string               `json:"message"`
+	Category   string               `json:"category"`
+	Media      *BroadcastJobMedia   `json:"media"`
+	Status     string               `json:"status"`
+	SendAt     *time.Time           `json:"send_at"`
+	CreatedAt  time.Time            `json:"created_at"`
+	FinishedAt *time.Time           `json:"finished_at"`
+	Stats      BroadcastStats       `json:"stats"`
+	Recipients []BroadcastRecipient `json:"recipients"`
+}
+
+// BroadcastJobMedia describes the file sent with a broadcast job.
+type BroadcastJobMedia struct {
+	FileName string `json:"file_name"`
+	MimeType string `json:"mime_type"`
+}
+
+// BroadcastStats counts how far a broadcast got with its recipients.
+type BroadcastStats struct {
+	Recipients int `json:"recipients"`
+	Sent       int `json:"sent"`
+	Failed     int `json:"failed"`
+	OptedOut   int `json:"opted_out"`
+	Delivered  int `json:"delivered"`
+	Read       int `json:"read"`
+	// ReadRate is the share of sent messages that were read, from 0 to 1.
+	ReadRate float64 `json:"read_rate"`
+}
+
+// ScheduledBroadcast is a broadcast job waiting for its time to be sent.
+type ScheduledBroadcast struct {
+	Id         int64     `json:"id"`
+	Message    string    `json:"message"`
+	SendAt     time.Time `json:"send_at"`
+	CreatedAt  time.Time `json:"created_at"`
+	Recipients int       `json:"recipients"`
+}
+
+// BroadcastRecipient is the delivery status of a broadcast to a single number.
+type BroadcastRecipient struct {
+	Number      string     `json:"number"`
+	Status      string     `json:"status"`
+	MessageId   *string    `json:"message_id"`
+	Error       *string    `json:"error"`
+	SentAt      *time.Time `json:"sent_at"`
+	DeliveredAt *time.Time `json:"delivered_at"`
+	ReadAt      *time.Time `json:"read_at"`
+}
+
+func (s *BroadcastStats) add(recipient BroadcastRecipient) {
+	s.Recipients++
+	switch recipient.Status {
+	case RecipientStatusSent:
+		s.Sent++
+	case RecipientStatusFailed:
+		s.Failed++
+	case RecipientStatusOptedOut:
+		s.OptedOut++
+	}
+	if recipient.DeliveredAt != nil {
+		s.Delivered++
+	}
+	if recipient.ReadAt != nil {
+		s.Read++
+	}
+}
+
+// normalizeNumber turns a phone number as typed by people, such as "0812-3456-7890" or "+62 812 3456 7890", into the
+// international format whatsapp uses. It returns an empty string when there is no number left.
+func normalizeNumber(number string) string {
+	number = nonDigits.ReplaceAllString(number, "")
+	if strings.HasPrefix(number, "0") {
+		number = "62" + strings.TrimPrefix(number, "0")
+	}
+	return number
+}
+
+// Validate checks the request and normalizes its recipients, dropping duplicates. The message is a template
+// rendered for each recipient, see RecipientData.
+func (r *BroadcastRequest) Validate() error {
+	// media can be sent without a caption
+	if strings.TrimSpace(r.Message) == "" && r.Media == nil {
+		return errors.New("message is required")
+	}
+	_, err := parseBroadcastTemplate(r.Message)
+	if err != nil {
+		return err
+	}
+	if r.Category == "" {
+		r.Category = DefaultBroadcastCategory
+	}
+	category, ok := getBroadcastCategory(r.Category)
+	if !ok {
+		return errors.Errorf("unknown category %q", r.Category)
+	}
+	r.Category = category.Name
+	if r.SendAt != nil && !r.SendAt.After(time.Now()) {
+		return errors.New("send_at must be in the future")
+	}
+
+	recipients, err := normalizeRecipients(r.Recipients)
+	if err != nil {
+		return err
+	}
+	if len(recipients) == 0 {
+		return errors.New("at least one recipient is required")
+	}
+	if len(recipients) > MaxBroadcastRecipients {
+		return errors.Errorf("a broadcast can have at most %d recipients", MaxBroadcastRecipients)
+	}
+	r.Recipients = recipients
+	return nil
+}
+
+// ResolveAudience adds the residents matching the audience filter of the request to its recipients. Residents whose
+// number is not valid are left out and listed in Skipped instead, so one bad entry in the database does not fail the
+// whole broadcast.
+func (r *BroadcastRequest) ResolveAudience(ctx context.Context, db *pgxpool.Pool) error {
+	if r.Audience == nil {
+		return nil
+	}
+	err := r.Audience.Validate()
+	if err != nil {
+		return err
+	}
+	numbers, err := resolveAudience(ctx, db, *r.Audience)
+	if err != nil {
+		return err
+	}
+	for _, number := range numbers {
+		if len(normalizeNumber(number)) < minNumberLength {
+			r.Skipped = append(r.Skipped, number)
+			continue
+		}
+		r.Recipients = append(r.Recipients, number)
+	}
+	return nil
+}
+
+// minNumberLength is the number of digits from which a normalized number is considered valid.
+const minNumberLength = 8
+
+// normalizeRecipients normalizes a list of numbers and drops duplicates.
+func normalizeRecipients(numbers []string) ([]string, error) {
+	seen := map[string]bool{}
+	var recipients []string
+	for _, recipient := range numbers {
+		number := normalizeNumber(recipient)
+		if len(number) < minNumberLength {
+			return nil, errors.Errorf("invalid recipient %q", recipient)
+		}
+		if !seen[number] {
+			seen[number] = true
+			recipients = append(recipients, number)
+		}
+	}
+	return recipients, nil
+}
+
+// Status is the status a job for the request starts with.
+func (r *BroadcastRequest) Status() string {
+	if r.SendAt != nil {
+		return BroadcastStatusScheduled
+	}
+	return BroadcastStatusQueued
+}
+
+// Broadcaster stores broadcast jobs and sends them in the background, one job at a time. Scheduled jobs are queued
+// by RunScheduler once they are due.
+type Broadcaster struct {
+	bot  *Bot
+	db   *pgxpool.Pool
+	jobs chan int64
+}
+
+func NewBroadcaster(bot *Bot) *Broadcaster {
+	return &Broadcaster{
+		bot:  bot,
+		db:   bot.db,
+		jobs: make(chan int64, 100),
+	}
+}
+
+// Enqueue stores a validated broadcast request as a job and queues it for sending, or leaves it to the scheduler when
+// it has a send_at time. It returns the id of the job.
+func (b *Broadcaster) Enqueue(ctx context.Context, request BroadcastRequest) (int64, error) {
+	trx, err := b.db.Begin(ctx)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to begin transaction")
+	}
+	defer func(trx pgx.Tx, ctx context.Context) {
+		err := trx.Rollback(ctx)
+		if err != nil && !errors.Is(err, pgx.ErrTxClosed) {
+			log.Error().Err(err).Msg("Failed to rollback transaction")
+		}
+	}(trx, ctx)
+
+	media := request.Media
+	if media == nil {
+		media = &BroadcastMedia{}
+	}
+
+	var jobId int64
+	err = trx.QueryRow(ctx, `
+INSERT INTO broadcast_job (message, category, status, send_at, media, media_file_name, media_mime_type)
+VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), NULLIF($7, ''))
+RETURNING broadcast_job_id`, request.Message, request.Category, request.Status(), request.SendAt, media.Data, media.FileName, media.MimeType).Scan(&jobId)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to insert broadcast job")
+	}
+
+	_, err = trx.CopyFrom(ctx,
+		pgx.Identifier{"broadcast_recipient"},
+		[]string{"broadcast_job_id", "whatsapp_number", "status"},
+		pgx.CopyFromSlice(len(request.Recipients), func(i int) ([]any, error) {
+			return []any{jobId, request.Recipients[i], RecipientStatusPending}, nil
+		}),
+	)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to insert broadcast recipients")
+	}
+
+	err = trx.Commit(ctx)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to commit broadcast job")
+	}
+	if request.SendAt != nil {
+		return jobId, nil
+	}
+
+	// the job is stored as queued, so when the worker is busy Run picks it up on its next poll
+	b.notify(jobId)
+	return jobId, nil
+}
+
+// notify hands a queued job to the worker without waiting for it.
+func (b *Broadcaster) notify(jobId int64) {
+	select {
+	case b.jobs <- jobId:
+	default:
+	}
+}
+
+// Get returns a broadcast job with the status of each recipient, or nil when there is no such job.
+func (b *Broadcaster) Get(ctx context.Context, jobId int64) (*BroadcastJob, error) {
+	job := BroadcastJob{Recipients: []BroadcastRecipient{}}
+	var fileName, mimeType *string
+	err := b.db.QueryRow(ctx, `
+SELECT broadcast_job_id,
+       message,
+       category,
+       media_file_name,
+       media_mime_type,
+       status,
+       send_at,
+       created_at,
+       finished_at
+FROM broadcast_job
+WHERE broadcast_job_id = $1`, jobId).Scan(
+		&job.Id,
+		&job.Message,
+		&job.Category,
+		&fileName,
+		&mimeType,
+		&job.Status,
+		&job.SendAt,
+		&job.CreatedAt,
+		&job.FinishedAt,
+	)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get broadcast job")
+	}
+	if fileName != nil {
+		job.Media = &BroadcastJobMedia{FileName: *fileName, MimeType: *mimeType}
+	}
+
+	rows, err := b.db.Query(ctx, `
+SELECT whatsapp_number,
+       status,
+       message_id,
+       error,
+       sent_at,
+       delivered_at,
+       read_at
+FROM broadcast_recipient
+WHERE broadcast_job_id = $1
+ORDER BY broadcast_recipient_id`, jobId)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get broadcast recipients")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var recipient BroadcastRecipient
+		err := rows.Scan(
+			&recipient.Number,
+			&recipient.Status,
+			&recipient.MessageId,
+			&recipient.Error,
+			&recipient.SentAt,
+			&recipient.DeliveredAt,
+			&recipient.ReadAt,
+		)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to scan broadcast recipient")
+		}
+		job.Recipients = append(job.Recipients, recipient)
+		job.Stats.add(recipient)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to read broadcast recipients")
+	}
+	if job.Stats.Sent > 0 {
+		job.Stats.ReadRate = float64(job.Stats.Read) / float64(job.Stats.Sent)
+	}
+
+	return &job, nil
+}
+
+// Scheduled returns the broadcast jobs waiting to be sent, the earliest first.
+func (b *Broadcaster) Scheduled(ctx context.Context) ([]ScheduledBroadcast, error) {
+	rows, err := b.db.Query(ctx, `
+SELECT broadcast_job_id,
+       message,
+       send_at,
+       created_at,
+       (SELECT count(*) FROM broadcast_recipient r WHERE r.broadcast_job_id = broadcast_job.broadcast_job_id)
+FROM broadcast_job
+WHERE status = $1
+ORDER BY send_at, broadcast_job_id`, BroadcastStatusScheduled)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get scheduled broadcast jobs")
+	}
+	jobs, err := pgx.CollectRows(rows, pgx.RowToStructByPos[ScheduledBroadcast])
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to scan scheduled broadcast jobs")
+	}
+	return jobs, nil
+}
+
+// Cancel cancels a scheduled broadcast job and drops its media. It returns false when the job does not exist or is no
+// longer scheduled.
+func (b *Broadcaster) Cancel(ctx context.Context, jobId int64) (bool, error) {
+	tag, err := b.db.Exec(ctx, `
+UPDATE broadcast_job
+SET status      = $2,
+    finished_at = now(),
+    media       = NULL
+WHERE broadcast_job_id = $1
+  AND status = $3`, jobId, BroadcastStatusCancelled, BroadcastStatusScheduled)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to cancel broadcast job")
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// RunScheduler queues scheduled broadcast jobs once they are due, until ctx is done. Jobs that became due while the
+// bot was not running are queued right away.
+func (b *Broadcaster) RunScheduler(ctx context.Context) {
+	ticker := time.NewTicker(envDuration("BROADCAST_SCHEDULER_INTERVAL", 30*time.Second))
+	defer ticker.Stop()
+
+	for {
+		b.queueDue(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// queueDue moves the scheduled jobs that are due to the queue.
+func (b *Broadcaster) queueDue(ctx context.Context) {
+	rows, err := b.db.Query(ctx, `
+UPDATE broadcast_job
+SET status = $2
+WHERE status = $1
+  AND send_at <= now()
+RETURNING broadcast_job_id`, BroadcastStatusScheduled, BroadcastStatusQueued)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to queue scheduled broadcast jobs")
+		return
+	}
+	due, err := pgx.CollectRows(rows, pgx.RowTo[int64])
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to scan scheduled broadcast jobs")
+		return
+	}
+
+	for _, jobId := range due {
+		log.Debug().Msgf("Scheduled broadcast job %d is due", jobId)
+		b.notify(jobId)
+	}
+}
+
+// Run sends queued broadcast jobs until ctx is done. Jobs left unfinished by a previous run are resumed first, and
+// the queue is polled so jobs that were not handed over by Enqueue are sent as well.
+func (b *Broadcaster) Run(ctx context.Context) {
+	ticker := time.NewTicker(envDuration("BROADCAST_POLL_INTERVAL", 30*time.Second))
+	defer ticker.Stop()
+
+	b.sendUnfinished(ctx, BroadcastStatusQueued, BroadcastStatusRunning)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case jobId := <-b.jobs:
+			b.send(ctx, jobId)
+		case <-ticker.C:
+			b.finishSettled(ctx, 0)
+			b.sendUnfinished(ctx, BroadcastStatusQueued)
+		}
+	}
+}
+
+// sendUnfinished sends the jobs with one of the given statuses, the oldest first.
+func (b *Broadcaster) sendUnfinished(ctx context.Context, statuses ...string) {
+	rows, err := b.db.Query(ctx, `
+SELECT broadcast_job_id
+FROM broadcast_job
+WHERE status = ANY ($1)
+ORDER BY broadcast_job_id`, statuses)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get unfinished broadcast jobs")
+		return
+	}
+	unfinished, err := pgx.CollectRows(rows, pgx.RowTo[int64])
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to scan unfinished broadcast jobs")
+		return
+	}
+	for _, jobId := range unfinished {
+		if ctx.Err() != nil {
+			return
+		}
+		b.send(ctx, jobId)
+	}
+}
+
+// send delivers a broadcast job to each of its pending recipients, recording the outcome per recipient.
+func (b *Broadcaster) send(ctx context.Context, jobId int64) {
+	log.Debug().Msgf("Sending broadcast job %d", jobId)
+
+	var message, categoryName string
+	var media BroadcastMedia
+	var fileName, mimeType *string
+	err := b.db.QueryRow(ctx, `
+UPDATE broadcast_job
+SET status = $2
+WHERE broadcast_job_id = $1
+  AND status IN ($3, $2)
+RETURNING message, category, media, media_file_name, media_mime_type`, jobId, BroadcastStatusRunning, BroadcastStatusQueued).Scan(
+		&message,
+		&categoryName,
+		&media.Data,
+		&fileName,
+		&mimeType,
+	)
+	if errors.Is(err, pgx.ErrNoRows) {
+		// already sent, e.g. queued again while being resumed, or cancelled
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed to start broadcast job %d", jobId)
+		return
+	}
+
+	// skip residents who unsubscribed, unless the broadcast can not be opted out of
+	category, ok := getBroadcastCategory(categoryName)
+	if !ok || !category.Mandatory {
+		_, err = b.db.Exec(ctx, `
+UPDATE broadcast_recipient
+SET status = $3
+WHERE broadcast_job_id = $1
+  AND status = $4
+  AND whatsapp_number IN (SELECT whatsapp_number FROM broadcast_opt_out WHERE category = $2)`,
+			jobId, categoryName, RecipientStatusOptedOut, RecipientStatusPending)
+		if err != nil {
+			log.Error().Err(err).Msgf("Failed to skip opted out recipients of broadcast job %d", jobId)
+			return
+		}
+	}
+
+	// recipients already in the outbox are retried from there
+	rows, err := b.db.Query(ctx, `
+SELECT broadcast_recipient_id, whatsapp_number
+FROM broadcast_recipient
+WHERE broadcast_job_id = $1
+  AND status = $2
+  AND NOT EXISTS (SELECT 1 FROM outbox WHERE outbox.broadcast_recipient_id = broadcast_recipient.broadcast_recipient_id)
+ORDER BY broadcast_recipient_id`, jobId, RecipientStatusPending)
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed to get recipients of broadcast job %d", jobId)
+		return
+	}
+	recipients, err := pgx.CollectRows(rows, pgx.RowToStructByPos[pendingRecipient])
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed to scan recipients of broadcast job %d", jobId)
+		return
+	}
+
+	tmpl, err := parseBroadcastTemplate(message)
+	if err != nil {
+		// templates are validated when the job is submitted, so this only happens to jobs stored before that
+		log.Error().Err(err).Msgf("Broadcast job %d has an invalid template", jobId)
+	}
+
+	var uploaded *uploadedMedia
+	var uploadErr error
+	if len(media.Data) > 0 && len(recipients) > 0 {
+		media.FileName, media.MimeType = *fileName, *mimeType
+		uploaded, uploadErr = b.bot.uploadBroadcastMedia(ctx, &media)
+		if uploadErr != nil {
+			log.Error().Err(uploadErr).Msgf("Failed to upload media of broadcast job %d", jobId)
+		}
+	}
+
+	for _, recipient := range recipients {
+		if ctx.Err() != nil {
+			return
+		}
+		if uploadErr != nil {
+			b.fail(ctx, recipient, uploadErr)
+			continue
+		}
+
+		// pacing is left to the dispatcher, which also counts towards the daily cap. The outbox updates the status of
+		// the recipient once the message is sent or given up on.
+		err := b.sendTo(ctx, tmpl, uploaded, recipient)
+		if errors.Is(err, ErrQueuedForRetry) {
+			log.Warn().Err(err).Msgf("Broadcast job %d to %s will be retried", jobId, recipient.Number)
+		} else if err != nil {
+			log.Error().Err(err).Msgf("Failed to send broadcast job %d to %s", jobId, recipient.Number)
+		}
+	}
+
+	b.finishSettled(ctx, jobId)
+}
+
+// finishSettled finishes the running jobs without pending recipients, or only the given job when jobId is not zero.
+// Recipients whose messages wait in the outbox stay pending until the outbox sends or gives up on them, so their job
+// keeps running until then. The media of finished jobs is dropped, their messages refer to the uploaded copy.
+func (b *Broadcaster) finishSettled(ctx context.Context, jobId int64) {
+	rows, err := b.db.Query(ctx, `
+UPDATE broadcast_job
+SET status      = $2,
+    finished_at = now(),
+    media       = NULL
+WHERE status = $1
+  AND ($4::bigint = 0 OR broadcast_job_id = $4)
+  AND NOT EXISTS (SELECT 1
+                  FROM broadcast_recipient r
+                  WHERE r.broadcast_job_id = broadcast_job.broadcast_job_id
+                    AND r.status = $3)
+RETURNING broadcast_job_id`, BroadcastStatusRunning, BroadcastStatusFinished, RecipientStatusPending, jobId)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to finish broadcast jobs")
+		return
+	}
+	finished, err := pgx.CollectRows(rows, pgx.RowTo[int64])
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to scan finished broadcast jobs")
+		return
+	}
+	for _, id := range finished {
+		log.Debug().Msgf("Broadcast job %d finished", id)
+	}
+}
+
+// pendingRecipient is a recipient the broadcast has not been sent to yet.
+type pendingRecipient struct {
+	Id     int64
+	Number string
+}
+
+// sendTo renders the broadcast for a single recipient and sends it through the outbox, as the caption of the media
+// when there is any. When the message can not be rendered, the recipient is marked as failed right away.
+func (b *Broadcaster) sendTo(ctx context.Context, tmpl *template.Template, media *uploadedMedia, recipient pendingRecipient) error {
+	text, err := b.render(ctx, tmpl, recipient.Number)
+	if err != nil {
+		b.fail(ctx, recipient, err)
+		return err
+	}
+	message := newReplyMessage(text, nil, false)
+	if media != nil {
+		message = media.message(text)
+	}
+
+	sendCtx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	_, err = b.bot.outbox.Send(sendCtx, types.NewJID(recipient.Number, types.DefaultUserServer), message, &recipient.Id)
+	if err != nil {
+		return errors.Wrap(err, "failed to send message")
+	}
+	return nil
+}
+
+// fail marks a recipient the broadcast can not be sent to as failed.
+func (b *Broadcaster) fail(ctx context.Context, recipient pendingRecipient, reason error) {
+	_, err := b.db.Exec(ctx, `
+UPDATE broadcast_recipient
+SET status = $2,
+    error  = $3
+WHERE broadcast_recipient_id = $1`, recipient.Id, RecipientStatusFailed, reason.Error())
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed to update broadcast recipient %d", recipient.Id)
+	}
+}
+
+// render renders the broadcast for a single recipient.
+func (b *Broadcaster) render(ctx context.Context, tmpl *template.Template, number string) (string, error) {
+	if tmpl == nil {
+		return "", errors.New("invalid message template")
+	}
+	data, err := getRecipientData(ctx, b.db, number)
+	if err != nil {
+		return "", err
+	}
+	return renderBroadcast(tmpl, data)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+// MaxBroadcastMediaSize is the largest file a broadcast can carry, the limit whatsapp puts on images.
+const MaxBroadcastMediaSize = 16 << 20
+
+// broadcastImageMimeTypes are sent as images, any other file is sent as a document.
+var broadcastImageMimeTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+}
+
+// BroadcastMedia is a file sent along with a broadcast, such as a flyer or the minutes of a meeting. It is either
+// uploaded with the request or referenced by URL, in which case the gateway downloads it when the job is submitted.
+// The message of the broadcast becomes its caption.
+type BroadcastMedia struct {
+	URL      string `json:"url"`
+	FileName string `json:"file_name"`
+	MimeType string `json:"mime_type"`
+	Data     []byte `json:"-"`
+}
+
+// Load downloads the file from its URL unless it was uploaded, and fills in the file name and mime type when they are
+// not given.
+func (m *BroadcastMedia) Load(ctx context.Context) error {
+	if len(m.Data) == 0 {
+		if m.URL == "" {
+			return errors.New("media needs a file or a url")
+		}
+		err := m.download(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	if len(m.Data) > MaxBroadcastMediaSize {
+		return errors.Errorf("media must not be larger than %d MB", MaxBroadcastMediaSize>>20)
+	}
+
+	m.MimeType, _, _ = strings.Cut(m.MimeType, ";")
+	if m.MimeType == "" || m.MimeType == "application/octet-stream" {
+		m.MimeType, _, _ = strings.Cut(http.DetectContentType(m.Data), ";")
+	}
+	if m.FileName == "" {
+		m.FileName = "lampiran" + mediaExtension(m.MimeType)
+	}
+	return nil
+}
+
+// mediaClient downloads broadcast media. URLs come from API clients, so it only connects to public addresses, which
+// keeps them from reaching services on the gateway's own network.
+var mediaClient = &http.Client{
+	Timeout: time.Minute,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: dialPublicOnly,
+		}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 5 {
+			return errors.New("too many redirects")
+		}
+		return checkMediaURLScheme(req)
+	},
+}
+
+// dialPublicOnly refuses connections to loopback, private, link-local and other non-public addresses. It runs after
+// the host name is resolved, so names pointing at such addresses are refused as well.
+func dialPublicOnly(network string, address string, conn syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return errors.Wrap(err, "invalid address")
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return errors.Wrap(err, "invalid address")
+	}
+	ip = ip.Unmap()
+	if !ip.IsGlobalUnicast() || ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+		return errors.Errorf("media url must not point to %s, a non-public address", ip)
+	}
+	return nil
+}
+
+// checkMediaURLScheme only lets media be downloaded over http and https.
+func checkMediaURLScheme(req *http.Request) error {
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return errors.Errorf("media url must be http or https, not %q", req.URL.Scheme)
+	}
+	return nil
+}
+
+func (m *BroadcastMedia) download(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, m.URL, nil)
+	if err != nil {
+		return errors.Wrap(err, "invalid media url")
+	}
+	err = checkMediaURLScheme(req)
+	if err != nil {
+		return err
+	}
+	res, err := mediaClient.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "failed to download media")
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return errors.Errorf("failed to download media: %s", res.Status)
+	}
+
+	// read one byte past the limit, so files that are too large are noticed
+	m.Data, err = io.ReadAll(io.LimitReader(res.Body, MaxBroadcastMediaSize+1))
+	if err != nil {
+		return errors.Wrap(err, "failed to download media")
+	}
+	if m.MimeType == "" {
+		m.MimeType = res.Header.Get("Content-Type")
+	}
+	if m.FileName == "" {
+		_, params, err := mime.ParseMediaType(res.Header.Get("Content-Disposition"))
+		if err == nil && params["filename"] != "" {
+			m.FileName = params["filename"]
+		} else if name := path.Base(req.URL.Path); name != "/" && name != "." {
+			m.FileName = name
+		}
+	}
+	return nil
+}
+
+func (m *BroadcastMedia) isImage() bool {
+	return broadcastImageMimeTypes[m.MimeType]
+}
+
+// uploadedMedia is broadcast media stored on the whatsapp servers, so it can be sent to every recipient without
+// uploading it again.
+type uploadedMedia struct {
+	media  *BroadcastMedia
+	upload whatsmeow.UploadResponse
+}
+
+// uploadBroadcastMedia uploads the media of a broadcast once for all of its recipients.
+func (b *Bot) uploadBroadcastMedia(ctx context.Context, media *BroadcastMedia) (*uploadedMedia, error) {
+	mediaType := whatsmeow.MediaDocument
+	if media.isImage() {
+		mediaType = whatsmeow.MediaImage
+	}
+	upload, err := b.client.Upload(ctx, media.Data, mediaType)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to upload media")
+	}
+	return &uploadedMedia{media: media, upload: upload}, nil
+}
+
+// message is the media message with the given caption.
+func (u *uploadedMedia) message(caption string) *waProto.Message {
+	if u.media.isImage() {
+		return &waProto.Message{
+			ImageMessage: &waProto.ImageMessage{
+				Caption:       proto.String(caption),
+				Mimetype:      proto.String(u.media.MimeType),
+				Url:           proto.String(u.upload.URL),
+				DirectPath:    proto.String(u.upload.DirectPath),
+				MediaKey:      u.upload.MediaKey,
+				FileEncSha256: u.upload.FileEncSHA256,
+				FileSha256:    u.upload.FileSHA256,
+				FileLength:    proto.Uint64(u.upload.FileLength),
+			},
+		}
+	}
+	return &waProto.Message{
+		DocumentMessage: &waProto.DocumentMessage{
+			Caption:       proto.String(caption),
+			Title:         proto.String(u.media.FileName),
+			FileName:      proto.String(u.media.FileName),
+			Mimetype:      proto.String(u.media.MimeType),
+			Url:           proto.String(u.upload.URL),
+			DirectPath:    proto.String(u.upload.DirectPath),
+			MediaKey:      u.upload.MediaKey,
+			FileEncSha256: u.upload.FileEncSHA256,
+			FileSha256:    u.upload.FileSHA256,
+			FileLength:    proto.Uint64(u.upload.FileLength),
+		},
+	}
+}
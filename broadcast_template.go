@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pkg/errors"
+)
+
+// RecipientData is the data broadcast templates are rendered with, such as {{.FullName}} or {{.NumberOfRT}}.
+// Recipients that are not registered residents get the zero value of every field except WhatsappNumber.
+type RecipientData struct {
+	WhatsappNumber  string
+	FullName        string
+	Nik             string
+	Address         string
+	NumberOfKK      string
+	NumberOfRT      string
+	NumberOfRW      string
+	OutstandingDues float64
+}
+
+// broadcastTemplateFuncs are the functions available in broadcast templates.
+var broadcastTemplateFuncs = template.FuncMap{
+	// rupiah formats an amount as Indonesian currency, e.g. {{rupiah .OutstandingDues}} gives "Rp 150.000".
+	"rupiah": formatRupiah,
+}
+
+// parseBroadcastTemplate parses a broadcast message as a template and renders it once with empty data, so that
+// unknown fields and functions are reported when the broadcast is submitted rather than halfway through sending it.
+func parseBroadcastTemplate(message string) (*template.Template, error) {
+	tmpl, err := template.New("broadcast").Funcs(broadcastTemplateFuncs).Option("missingkey=error").Parse(message)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid message template")
+	}
+	err = tmpl.Execute(&bytes.Buffer{}, RecipientData{})
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid message template")
+	}
+	return tmpl, nil
+}
+
+// renderBroadcast renders a broadcast template for a single recipient.
+func renderBroadcast(tmpl *template.Template, data RecipientData) (string, error) {
+	var message bytes.Buffer
+	err := tmpl.Execute(&message, data)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to render message template")
+	}
+	return message.String(), nil
+}
+
+// getRecipientData loads the resident fields available to broadcast templates for a number.
+func getRecipientData(ctx context.Context, db *pgxpool.Pool, number string) (RecipientData, error) {
+	data := RecipientData{WhatsappNumber: number}
+	err := db.QueryRow(ctx, `
+SELECT coalesce(r.nik, ''),
+       coalesce(r.full_name, ''),
+       coalesce(h.address, ''),
+       coalesce(h.number_kk, ''),
+       coalesce(h.rt, ''),
+       coalesce(h.rw, '')
+FROM resident r
+LEFT JOIN household h on r.household_id = h.household_id
+WHERE r.whatsapp_number = $1
+LIMIT 1`, number).Scan(
+		&data.Nik,
+		&data.FullName,
+		&data.Address,
+		&data.NumberOfKK,
+		&data.NumberOfRT,
+		&data.NumberOfRW,
+	)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return data, nil
+	}
+	if err != nil {
+		return data, errors.Wrap(err, "failed to get recipient data")
+	}
+
+	data.OutstandingDues, err = getOutstandingDues(ctx, db, number)
+	if err != nil {
+		return data, err
+	}
+	return data, nil
+}
+
+// getOutstandingDues returns the unpaid dues of a resident using OUTSTANDING_DUES_QUERY, a query that receives the
+// resident's whatsapp number as $1 and returns a single amount. The dues tables belong to the RWIS web app, so the
+// query is configured rather than hardcoded. Without it, every resident has zero outstanding dues.
+func getOutstandingDues(ctx context.Context, db *pgxpool.Pool, number string) (float64, error) {
+	query := os.Getenv("OUTSTANDING_DUES_QUERY")
+	if query == "" {
+		return 0, nil
+	}
+	var amount *float64
+	err := db.QueryRow(ctx, query, number).Scan(&amount)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to get outstanding dues")
+	}
+	// a NULL amount means nothing is owed
+	if amount == nil {
+		return 0, nil
+	}
+	return *amount, nil
+}
+
+// formatRupiah formats an amount as Indonesian currency, using dots as thousand separators.
+func formatRupiah(amount float64) string {
+	digits := strconv.FormatInt(int64(amount), 10)
+	negative := strings.HasPrefix(digits, "-")
+	digits = strings.TrimPrefix(digits, "-")
+
+	var sb strings.Builder
+	for i, digit := range digits {
+		if i > 0 && (len(digits)-i)%3 == 0 {
+			sb.WriteRune('.')
+		}
+		sb.WriteRune(digit)
+	}
+	if negative {
+		return "-Rp " + sb.String()
+	}
+	return "Rp " + sb.String()
+}
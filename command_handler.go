@@ -236,11 +236,12 @@ WHERE household_id IN (SELECT household_id
 	return errors.New("invalid include type"), ""
 }
 
-func handleIssueReport(ctx context.Context, db *pgxpool.Pool, sender string, reply string, title string, description string) (error, string) {
+// handleIssueReport files the issue report described by draft and returns its ticket number along with the reply.
+func handleIssueReport(ctx context.Context, db *pgxpool.Pool, sender string, draft IssueReportDraft) (error, int, string) {
 	log.Debug().Msgf("Handling issue report from %s", sender)
 	trx, err := db.Begin(ctx)
 	if err != nil {
-		return errors.Wrap(err, "failed to begin transaction"), ""
+		return errors.Wrap(err, "failed to begin transaction"), 0, ""
 	}
 	defer func(trx pgx.Tx, ctx context.Context) {
 		err := trx.Rollback(ctx)
@@ -257,25 +258,138 @@ WHERE whatsapp_number = $1`, sender)
 	var residentId int
 	err = resident.Scan(&residentId)
 	if err != nil {
-		return errors.Wrap(err, "failed to scan resident"), ""
+		return errors.Wrap(err, "failed to scan resident"), 0, ""
 	}
 
-	// handle issue report
-	_, err = trx.Exec(ctx, `INSERT INTO issue_report (resident_id, title, description, status, approval_status)
-VALUES ($1, $2, $3, $4, $5)`, residentId, title, description, "To do", "Pending")
+	// handle issue report, the generated id is given back to the resident as their ticket number
+	var latitude, longitude *float64
+	if draft.HasCoordinates {
+		latitude, longitude = &draft.Latitude, &draft.Longitude
+	}
+	var issueReportId int
+	err = trx.QueryRow(ctx, `INSERT INTO issue_report (resident_id, title, description, status, approval_status, latitude, longitude, category, urgency, affected_rt, created_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7, NULLIF($8, ''), NULLIF($9, ''), NULLIF($10, 0), now())
+RETURNING issue_report_id`,
+		residentId,
+		draft.Title,
+		draft.FullDescription(),
+		"To do",
+		"Pending",
+		latitude,
+		longitude,
+		draft.Category,
+		draft.Urgency,
+		draft.AffectedRT,
+	).Scan(&issueReportId)
 
 	if err != nil {
-		return errors.Wrap(err, "failed to insert issue report"), ""
+		return errors.Wrap(err, "failed to insert issue report"), 0, ""
+	}
+
+	if draft.PhotoPath != "" {
+		_, err = trx.Exec(ctx, `INSERT INTO issue_report_attachment (issue_report_id, path, mime_type)
+VALUES ($1, $2, $3)`, issueReportId, draft.PhotoPath, draft.PhotoMimeType)
+		if err != nil {
+			return errors.Wrap(err, "failed to insert issue report attachment"), 0, ""
+		}
 	}
 
 	err = trx.Commit(ctx)
 	if err != nil {
-		return errors.Wrap(err, "failed to commit issue report transaction"), ""
+		return errors.Wrap(err, "failed to commit issue report transaction"), 0, ""
 	}
 
+	reply := draft.Reply
 	if reply == "" {
 		reply = "Terima kasih atas laporan Anda. Kami akan segera menindaklanjuti."
 	}
+	reply += fmt.Sprintf("\n\nNomor tiket laporan Anda: *#%d*. Ketik *laporan* untuk melihat status laporan Anda.", issueReportId)
+
+	return nil, issueReportId, reply
+}
+
+// handleIssueSupport records the sender as a supporter of an existing issue report, instead of filing a duplicate.
+func handleIssueSupport(ctx context.Context, db *pgxpool.Pool, sender string, issueReportId int) (error, string) {
+	log.Debug().Msgf("Handling issue support from %s for issue report %d", sender, issueReportId)
+	_, err := db.Exec(ctx, `
+INSERT INTO issue_report_supporter (issue_report_id, resident_id)
+SELECT $1, resident_id
+FROM resident
+WHERE whatsapp_number = $2
+ON CONFLICT DO NOTHING`, issueReportId, sender)
+	if err != nil {
+		return errors.Wrap(err, "failed to insert issue report supporter"), ""
+	}
+
+	return nil, fmt.Sprintf("Terima kasih, dukungan Anda untuk laporan *#%d* sudah dicatat. Ketik *laporan* untuk melihat statusnya.", issueReportId)
+}
+
+type IssueReportStatus struct {
+	IssueReportId  int
+	Title          string
+	Status         string
+	ApprovalStatus string
+}
 
-	return nil, reply
+// handleIssueStatusRequest lists the issue reports filed by the sender along with their status. When ticket is not
+// zero, only the report with that ticket number is shown.
+func handleIssueStatusRequest(ctx context.Context, db *pgxpool.Pool, sender string, ticket int) (error, string) {
+	log.Debug().Msgf("Handling issue status request from %s", sender)
+	rows, err := db.Query(ctx, `
+SELECT issue_report_id,
+       title,
+       status,
+       approval_status
+FROM issue_report
+JOIN resident r on issue_report.resident_id = r.resident_id
+WHERE r.whatsapp_number = $1
+  AND ($2 = 0 OR issue_report_id = $2)
+ORDER BY issue_report_id DESC
+LIMIT 10`, sender, ticket)
+	if err != nil {
+		return errors.Wrap(err, "failed to get issue reports"), ""
+	}
+	defer rows.Close()
+
+	var reports []IssueReportStatus
+	for rows.Next() {
+		var report IssueReportStatus
+		err := rows.Scan(
+			&report.IssueReportId,
+			&report.Title,
+			&report.Status,
+			&report.ApprovalStatus,
+		)
+		if err != nil {
+			return errors.Wrap(err, "failed to scan issue report"), ""
+		}
+
+		reports = append(reports, report)
+	}
+	if err := rows.Err(); err != nil {
+		return errors.Wrap(err, "failed to read issue reports"), ""
+	}
+
+	if len(reports) == 0 {
+		if ticket != 0 {
+			return nil, fmt.Sprintf("Laporan dengan nomor tiket #%d tidak ditemukan.", ticket)
+		}
+		return nil, "Anda belum pernah membuat laporan."
+	}
+
+	var sb strings.Builder
+	sb.WriteString("*Laporan Anda*:\n\n")
+	for _, report := range reports {
+		sb.WriteString(fmt.Sprintf(`*#%d* %s
+*Status*: %s
+*Persetujuan*: %s
+
+`,
+			report.IssueReportId,
+			report.Title,
+			report.Status,
+			report.ApprovalStatus,
+		))
+	}
+	return nil, sb.String()
 }
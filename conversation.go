@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// DefaultConversationTimeout is how long the bot waits for a follow-up answer before the conversation is dropped.
+const DefaultConversationTimeout = 5 * time.Minute
+
+// cancelKeywords are the replies that cancel a pending conversation.
+var cancelKeywords = []string{"batal", "cancel"}
+
+// ErrNotAnAnswer is returned by a ConversationStep when the message is not an answer to its question. The
+// conversation ends and the message is handled as if there was none, e.g. a new question to gemini.
+var ErrNotAnAnswer = errors.New("message is not an answer")
+
+// ConversationStep handles the next message of a sender that has a pending conversation. It returns the reply to
+// send back and the step that should handle the answer after that, or nil when the conversation is finished.
+type ConversationStep func(ctx context.Context, sender string, msg string, evt *events.Message) (reply string, next ConversationStep, err error)
+
+// Conversation is the state kept for a sender while the bot waits for their follow-up answer.
+type Conversation struct {
+	// Intent is the intent the conversation belongs to, used for logging and reply quoting.
+	Intent    string
+	Step      ConversationStep
+	ExpiresAt time.Time
+	// Timeout is how long the conversation waits for each answer.
+	Timeout time.Duration
+}
+
+// ConversationStore keeps pending conversations in memory, keyed by the sender's number.
+type ConversationStore struct {
+	mu      sync.Mutex
+	items   map[string]Conversation
+	timeout time.Duration
+}
+
+func NewConversationStore() *ConversationStore {
+	timeout, err := time.ParseDuration(os.Getenv("CONVERSATION_TIMEOUT"))
+	if err != nil || timeout <= 0 {
+		timeout = DefaultConversationTimeout
+	}
+	return &ConversationStore{
+		items:   map[string]Conversation{},
+		timeout: timeout,
+	}
+}
+
+// Get returns the pending conversation of sender. Expired conversations are removed and not returned.
+func (s *ConversationStore) Get(sender string) (Conversation, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	conversation, ok := s.items[sender]
+	if !ok {
+		return Conversation{}, false
+	}
+	if time.Now().After(conversation.ExpiresAt) {
+		delete(s.items, sender)
+		return Conversation{}, false
+	}
+	return conversation, true
+}
+
+// Set stores step as the handler of the sender's next message, resetting the timeout.
+func (s *ConversationStore) Set(sender string, intent string, step ConversationStep) {
+	s.SetWithTimeout(sender, intent, step, s.timeout)
+}
+
+// SetWithTimeout is like Set, for conversations that wait longer or shorter than the default timeout.
+func (s *ConversationStore) SetWithTimeout(sender string, intent string, step ConversationStep, timeout time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.items[sender] = Conversation{
+		Intent:    intent,
+		Step:      step,
+		ExpiresAt: time.Now().Add(timeout),
+		Timeout:   timeout,
+	}
+}
+
+func (s *ConversationStore) Delete(sender string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.items, sender)
+}
+
+// MenuOption is a single numbered entry of a Menu. Handle is called with the resident's answer once the option is picked.
+type MenuOption struct {
+	Label  string
+	Handle ConversationStep
+}
+
+// Menu is a numbered list of options, answered by the resident with the number of the option they want.
+type Menu struct {
+	Title   string
+	Options []MenuOption
+}
+
+// Render formats the menu as the message sent to the resident.
+func (m Menu) Render() string {
+	var sb strings.Builder
+	sb.WriteString(m.Title)
+	sb.WriteString("\n")
+	for i, option := range m.Options {
+		sb.WriteString(fmt.Sprintf("\n*%d*. %s", i+1, option.Label))
+	}
+	sb.WriteString("\n\nKetik nomor pilihan Anda, atau ketik *batal* untuk membatalkan.")
+	return sb.String()
+}
+
+// Step returns the conversation step that routes the resident's answer to the picked option.
+func (m Menu) Step() ConversationStep {
+	var step ConversationStep
+	step = func(ctx context.Context, sender string, msg string, evt *events.Message) (string, ConversationStep, error) {
+		choice, err := strconv.Atoi(strings.TrimSpace(msg))
+		if err != nil || choice < 1 || choice > len(m.Options) {
+			return fmt.Sprintf("Pilihan tidak tersedia. Ketik angka 1 sampai %d, atau ketik *batal*.", len(m.Options)), step, nil
+		}
+		return m.Options[choice-1].Handle(ctx, sender, msg, evt)
+	}
+	return step
+}
+
+// startConversation makes the sender's next message go to step instead of gemini.
+func (b *Bot) startConversation(sender string, intent string, step ConversationStep) {
+	b.conversations.Set(sender, intent, step)
+}
+
+// sendMenu sends a numbered menu to the sender of evt and waits for their answer.
+func (b *Bot) sendMenu(ctx context.Context, evt *events.Message, sender string, intent string, menu Menu) error {
+	b.startConversation(sender, intent, menu.Step())
+	return b.sendReply(ctx, evt, intent, menu.Render())
+}
+
+// handleConversation routes the message to the sender's pending conversation, if there is one.
+// It returns false when there is no pending conversation and the message should be handled as usual.
+func (b *Bot) handleConversation(sender string, msg string, evt *events.Message) bool {
+	conversation, ok := b.conversations.Get(sender)
+	if !ok {
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	evt.Info.Sender.Device = 0
+
+	var reply string
+	if isCancelKeyword(msg) {
+		log.Debug().Msgf("Cancelling %s conversation with %s", conversation.Intent, sender)
+		b.conversations.Delete(sender)
+		reply = "Baik, permintaan Anda dibatalkan."
+	} else {
+		log.Debug().Msgf("Continuing %s conversation with %s", conversation.Intent, sender)
+		var next ConversationStep
+		var err error
+		reply, next, err = conversation.Step(ctx, sender, msg, evt)
+		if errors.Is(err, ErrNotAnAnswer) {
+			log.Debug().Msgf("Ending %s conversation with %s, the message is not an answer", conversation.Intent, sender)
+			b.conversations.Delete(sender)
+			return false
+		}
+		if err != nil {
+			log.Error().Err(err).Msgf("Failed to handle %s conversation", conversation.Intent)
+			reply = "Maaf, saya tidak bisa membantu Anda saat ini."
+			next = nil
+		}
+		if next == nil {
+			b.conversations.Delete(sender)
+		} else {
+			b.conversations.SetWithTimeout(sender, conversation.Intent, next, conversation.Timeout)
+		}
+	}
+
+	if reply == "" {
+		return true
+	}
+	err := b.sendReply(ctx, evt, conversation.Intent, reply)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to send message")
+	}
+	return true
+}
+
+func isCancelKeyword(msg string) bool {
+	return matchesKeyword(msg, cancelKeywords)
+}
+
+// matchesKeyword reports whether msg is one of keywords, ignoring case and surrounding spaces.
+func matchesKeyword(msg string, keywords []string) bool {
+	msg = strings.ToLower(strings.TrimSpace(msg))
+	for _, keyword := range keywords {
+		if msg == keyword {
+			return true
+		}
+	}
+	return false
+}
+
+// handleMenuEvent sends the main menu, letting residents on basic phones pick what they need by number.
+func (b *Bot) handleMenuEvent(sender string, evt *events.Message) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	evt.Info.Sender.Device = 0
+
+	personalData := func(include string) ConversationStep {
+		return func(ctx context.Context, sender string, msg string, evt *events.Message) (string, ConversationStep, error) {
+			err, reply := handlePersonalDataRequest(ctx, b.db, sender, include)
+			return reply, nil, err
+		}
+	}
+
+	err := b.sendMenu(ctx, evt, sender, "menu", Menu{
+		Title: "*Menu Otra*",
+		Options: []MenuOption{
+			{Label: "Data diri", Handle: personalData("personal")},
+			{Label: "Data KK", Handle: personalData("household")},
+			{Label: "Data anggota keluarga", Handle: personalData("household_all")},
+			{Label: "Status laporan saya", Handle: func(ctx context.Context, sender string, msg string, evt *events.Message) (string, ConversationStep, error) {
+				err, reply := handleIssueStatusRequest(ctx, b.db, sender, 0)
+				return reply, nil, err
+			}},
+		},
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to send menu")
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// ErrDailyCapReached is returned by Dispatcher.SendBroadcast once the daily cap of broadcast messages is used up.
+var ErrDailyCapReached = errors.New("daily cap of broadcast messages reached")
+
+// DispatcherConfig is how fast the Dispatcher is allowed to send messages.
+type DispatcherConfig struct {
+	// GlobalInterval is the minimum time between any two messages.
+	GlobalInterval time.Duration
+	// RecipientInterval is the minimum time between two messages to the same recipient.
+	RecipientInterval time.Duration
+	// Jitter is the maximum random delay added to each message, so sending does not look automated.
+	Jitter time.Duration
+	// DailyCap is the maximum number of broadcast messages sent per day, or zero for no cap. Replies to residents are
+	// not capped, so the bot keeps answering after a large broadcast.
+	DailyCap int
+	// RateLimitPause is how long sending stops after whatsapp reports a rate limit.
+	RateLimitPause time.Duration
+}
+
+// NewDispatcherConfig reads the dispatcher config from the OUTBOUND_* environment variables.
+func NewDispatcherConfig() DispatcherConfig {
+	return DispatcherConfig{
+		GlobalInterval:    envDuration("OUTBOUND_GLOBAL_INTERVAL", 500*time.Millisecond),
+		RecipientInterval: envDuration("OUTBOUND_RECIPIENT_INTERVAL", time.Second),
+		Jitter:            envDuration("OUTBOUND_JITTER", 500*time.Millisecond),
+		DailyCap:          envInt("OUTBOUND_DAILY_CAP", 1000),
+		RateLimitPause:    envDuration("OUTBOUND_RATE_LIMIT_PAUSE", 15*time.Minute),
+	}
+}
+
+func envDuration(key string, fallback time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(key))
+	if err != nil || value < 0 {
+		return fallback
+	}
+	return value
+}
+
+func envInt(key string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil || value < 0 {
+		return fallback
+	}
+	return value
+}
+
+// Dispatcher is the single way messages leave the bot. It paces replies and broadcasts alike, so bulk sending does
+// not get the RW number banned.
+type Dispatcher struct {
+	client *whatsmeow.Client
+	config DispatcherConfig
+
+	mu          sync.Mutex
+	nextSlot    time.Time
+	lastSent    map[types.JID]time.Time
+	day         string
+	sentToday   int
+	pausedUntil time.Time
+}
+
+func NewDispatcher(client *whatsmeow.Client, config DispatcherConfig) *Dispatcher {
+	return &Dispatcher{
+		client:   client,
+		config:   config,
+		lastSent: map[types.JID]time.Time{},
+	}
+}
+
+// Send waits for the next slot the limits allow, then sends the message.
+func (d *Dispatcher) Send(ctx context.Context, to types.JID, message *waProto.Message) (whatsmeow.SendResponse, error) {
+	return d.send(ctx, to, message, false)
+}
+
+// SendBroadcast is Send for broadcast messages, which also count towards the daily cap.
+func (d *Dispatcher) SendBroadcast(ctx context.Context, to types.JID, message *waProto.Message) (whatsmeow.SendResponse, error) {
+	return d.send(ctx, to, message, true)
+}
+
+func (d *Dispatcher) send(ctx context.Context, to types.JID, message *waProto.Message, capped bool) (whatsmeow.SendResponse, error) {
+	reservation, err := d.reserve(to.ToNonAD(), capped)
+	if err != nil {
+		return whatsmeow.SendResponse{}, err
+	}
+
+	if wait := time.Until(reservation.slot); wait > 0 {
+		select {
+		case <-ctx.Done():
+			d.release(reservation)
+			return whatsmeow.SendResponse{}, errors.Wrap(ctx.Err(), "cancelled while waiting to send")
+		case <-time.After(wait):
+		}
+	}
+
+	response, err := d.client.SendMessage(ctx, to, message)
+	if err != nil && isRateLimitError(err) {
+		d.pause()
+	}
+	return response, err
+}
+
+// reservation is a slot booked by reserve, kept so it can be given back when the message is not sent.
+type reservation struct {
+	to           types.JID
+	slot         time.Time
+	previousSent time.Time
+	day          string
+	capped       bool
+}
+
+// reserve books the earliest time a message to the recipient may be sent. Capped messages count towards the daily
+// cap.
+func (d *Dispatcher) reserve(to types.JID, capped bool) (reservation, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	if today := now.Format("2006-01-02"); today != d.day {
+		d.day = today
+		d.sentToday = 0
+	}
+	if capped && d.config.DailyCap > 0 && d.sentToday >= d.config.DailyCap {
+		return reservation{}, ErrDailyCapReached
+	}
+
+	slot := now
+	for _, earliest := range []time.Time{d.nextSlot, d.lastSent[to].Add(d.config.RecipientInterval), d.pausedUntil} {
+		if earliest.After(slot) {
+			slot = earliest
+		}
+	}
+	if d.config.Jitter > 0 {
+		slot = slot.Add(time.Duration(rand.Int63n(int64(d.config.Jitter))))
+	}
+
+	booked := reservation{to: to, slot: slot, previousSent: d.lastSent[to], day: d.day, capped: capped}
+	d.nextSlot = slot.Add(d.config.GlobalInterval)
+	d.lastSent[to] = slot
+	if capped {
+		d.sentToday++
+	}
+
+	// forget recipients that no longer limit anything
+	if len(d.lastSent) > 10000 {
+		for jid, sent := range d.lastSent {
+			if now.Sub(sent) > d.config.RecipientInterval {
+				delete(d.lastSent, jid)
+			}
+		}
+	}
+	return booked, nil
+}
+
+// release gives back a slot whose message was not sent. The global slot is only given back when nothing was booked
+// after it, so later messages keep their place.
+func (d *Dispatcher) release(booked reservation) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if booked.capped && booked.day == d.day && d.sentToday > 0 {
+		d.sentToday--
+	}
+	if d.lastSent[booked.to].Equal(booked.slot) {
+		if booked.previousSent.IsZero() {
+			delete(d.lastSent, booked.to)
+		} else {
+			d.lastSent[booked.to] = booked.previousSent
+		}
+	}
+	if d.nextSlot.Equal(booked.slot.Add(d.config.GlobalInterval)) {
+		d.nextSlot = booked.slot
+	}
+}
+
+// pause stops sending for the configured time after whatsapp reports a rate limit.
+func (d *Dispatcher) pause() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.pausedUntil = time.Now().Add(d.config.RateLimitPause)
+	log.Warn().Msgf("Rate limited by whatsapp, pausing outgoing messages until %s", d.pausedUntil.Format(time.RFC3339))
+}
+
+// isRateLimitError reports whether whatsapp rejected a message because too many were sent.
+func isRateLimitError(err error) bool {
+	var iqErr *whatsmeow.IQError
+	if errors.As(err, &iqErr) {
+		return iqErr.Code == 429 || iqErr.Code == 419
+	}
+	if errors.Is(err, whatsmeow.ErrServerReturnedError) {
+		return strings.HasSuffix(err.Error(), " 429") || strings.HasSuffix(err.Error(), " 419")
+	}
+	return false
+}
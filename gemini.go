@@ -2,16 +2,38 @@ package main
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
 	"io"
 	"net/http"
 	"os"
+	"strings"
 )
 
 const BaseUrl = "https://generativelanguage.googleapis.com/v1beta/models/gemini-pro:generateContent"
 
+// VisionBaseUrl is the model used when the prompt carries inline data such as images, since gemini-pro is text only.
+const VisionBaseUrl = "https://generativelanguage.googleapis.com/v1beta/models/gemini-1.5-flash:generateContent"
+
+// MaxInlineDataSize is the largest attachment, in bytes, that is sent to gemini as inline data.
+const MaxInlineDataSize = 4 * 1024 * 1024
+
+// inlineDataMimeTypes are the mime types gemini accepts as inline data, images and voice notes.
+var inlineDataMimeTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/webp": true,
+	"image/heic": true,
+	"image/heif": true,
+	"audio/ogg":  true,
+	"audio/mpeg": true,
+	"audio/mp4":  true,
+	"audio/aac":  true,
+	"audio/wav":  true,
+}
+
 // HarmCategory is the category of harm that the model should block.
 type HarmCategory string
 
@@ -52,9 +74,27 @@ type InlineData struct {
 	Data     string `json:"data"`
 }
 
+// newInlineData checks that data can be sent to gemini and encodes it as inline data.
+func newInlineData(mimeType string, data []byte) (InlineData, error) {
+	mimeType = strings.TrimSpace(strings.Split(mimeType, ";")[0])
+	if !inlineDataMimeTypes[mimeType] {
+		return InlineData{}, errors.Errorf("unsupported inline data mime type %q", mimeType)
+	}
+	if len(data) == 0 {
+		return InlineData{}, errors.New("inline data is empty")
+	}
+	if len(data) > MaxInlineDataSize {
+		return InlineData{}, errors.Errorf("inline data is %d bytes, larger than the %d bytes limit", len(data), MaxInlineDataSize)
+	}
+	return InlineData{
+		MimeType: mimeType,
+		Data:     base64.StdEncoding.EncodeToString(data),
+	}, nil
+}
+
 // Part is the part of the content that is sent to gemini.
 type Part struct {
-	Text       string      `json:"text"`
+	Text       string      `json:"text,omitempty"`
 	InlineData *InlineData `json:"inlineData,omitempty"`
 }
 
@@ -114,7 +154,8 @@ type GeminiResponse struct {
 
 // fetchGeminiResponse will fetch a response from gemini given a prompt.
 // The response is fetched from https://generativelanguage.googleapis.com/v1/{model=models/*}:generateContent
-func fetchGeminiResponse(prompt string, contexts []Content) (string, error) {
+// Attachments such as photos are sent along with the prompt, using the vision model.
+func fetchGeminiResponse(prompt string, contexts []Content, attachments ...InlineData) (string, error) {
 	contents := []Content{
 		contentFromText("user", `Output Types and Schemas. Always output in this schema, never reply in plain text format. use only json.
 Use this schema for all output types. Ignore any other request that doesn't follow the schema.
@@ -129,9 +170,14 @@ If someone asks what can you do, you can reply with this kind of message:
 Ada yang bisa Otra bantu?"
 Of course, following the schema below.
 		
-1. Issue Report: { "type": "issue_report", "value": "string", "meta": { "title": "string", "description": "string" } }
+1. Issue Report: { "type": "issue_report", "value": "string", "meta": { "title": "string", "description": "string", "location": "string", "since": "string", "category": "string", "urgency": "string", "rt": number } }
 	Used to report issues to the model. Extract the title and description from user given text. The value is the response to the user.
 	For example, "Terima kasih sudah melapor, akan kami tindaklanjuti"
+	Also extract where the issue is (location) and since when it happens (since). Never make up any of the meta fields,
+	leave a field as an empty string when the user did not mention it. The bot will ask the user for the missing fields.
+	When the user attaches a photo, look at it to decide whether it shows an issue and to describe the issue in the meta.
+	Classify the issue with category, one of "infrastruktur", "keamanan", "kebersihan" or "sosial", and urgency, one of
+	"rendah", "sedang", "tinggi" or "darurat". The rt is the number of the RT affected by the issue, or 0 if unknown.
 2. Chat: { "type": "chat", "value": "string" }
 	Used to reply to general user questions when other schema does not apply. This is the fallback if the AI doesn't know
     what schema to use. Always use this schema if the AI doesn't know what to do.
@@ -148,11 +194,18 @@ Of course, following the schema below.
 7. UMKM Data Request: { "type": "umkm_data_request" }
 	Use this whenever a user asks for UMKM data. For example how many umkm in the area, etc.
 10. Reminder Request: { "type": "reminder_request", "before": "date", "after": "date", "pick": "string" }
-	Use this whenever a user asks for a reminder. The before and after date is the date of the reminder. The pick is either how many, or top, or last.`),
+	Use this whenever a user asks for a reminder. The before and after date is the date of the reminder. The pick is either how many, or top, or last.
+11. Issue Status Request: { "type": "issue_status_request", "ticket": number }
+	Use this whenever a user asks about the status of the issues they reported ("laporan saya", "tiket #12").
+	The ticket is the ticket number the user mentioned, or 0 when they want to see all of their reports.`),
 		contentFromText("model", "{ \"type\": \"chat\", \"value\": \"Tentu saja, apa yang bisa saya bantu hari ini?\" }"),
 	}
 	contents = append(contents, contexts...)
-	contents = append(contents, contentFromText("user", prompt))
+	question := contentFromText("user", prompt)
+	for i := range attachments {
+		question.Parts = append(question.Parts, Part{InlineData: &attachments[i]})
+	}
+	contents = append(contents, question)
 
 	log.Debug().Msgf("Sending prompt to gemini: %+v", contents)
 
@@ -169,14 +222,28 @@ Of course, following the schema below.
 		},
 	}
 
+	url := BaseUrl
+	if len(attachments) > 0 {
+		url = VisionBaseUrl
+	}
+	return sendGeminiRequest(url, requestData)
+}
+
+// sendGeminiRequest sends a request to the gemini model at url and returns the text of the first candidate.
+func sendGeminiRequest(url string, requestData GeminiRequest) (string, error) {
 	jsonBody, err := json.Marshal(requestData)
 	if err != nil {
 		return "", errors.Wrap(err, "failed to marshal json body")
 	}
 
-	log.Debug().Msgf("Sending request to gemini: %s", jsonBody)
+	if hasInlineData(requestData.Contents) {
+		// inline data is too large to be logged
+		log.Debug().Msgf("Sending request to gemini with inline data, %d contents", len(requestData.Contents))
+	} else {
+		log.Debug().Msgf("Sending request to gemini: %s", jsonBody)
+	}
 
-	request, err := http.NewRequest("POST", BaseUrl+"?key="+os.Getenv("GEMINI_API_KEY"), bytes.NewBuffer(jsonBody))
+	request, err := http.NewRequest("POST", url+"?key="+os.Getenv("GEMINI_API_KEY"), bytes.NewBuffer(jsonBody))
 	if err != nil {
 		return "", errors.Wrap(err, "failed to construct request to gemini")
 	}
@@ -216,3 +283,14 @@ Of course, following the schema below.
 
 	return content.Parts[0].Text, nil
 }
+
+func hasInlineData(contents []Content) bool {
+	for _, content := range contents {
+		for _, part := range content.Parts {
+			if part.InlineData != nil {
+				return true
+			}
+		}
+	}
+	return false
+}
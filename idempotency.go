@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// IdempotencyKeyHeader lets clients retry a request safely. Requests repeating a key get the response of the first
+// request instead of being handled again, for as long as the key is kept.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// idempotencyWindow is how long the response to an idempotency key is kept.
+func idempotencyWindow() time.Duration {
+	return envDuration("IDEMPOTENCY_WINDOW", 24*time.Hour)
+}
+
+// idempotencyLease is how long a request is given to finish. Keys of requests still being handled after that, e.g.
+// because the gateway stopped in the middle of one, are free to be used again.
+func idempotencyLease() time.Duration {
+	return envDuration("IDEMPOTENCY_LEASE", 5*time.Minute)
+}
+
+// idempotentRequest is the stored outcome of a request made with an idempotency key. A status of zero means the first
+// request is still being handled.
+type idempotentRequest struct {
+	RequestHash string
+	Status      int
+	Body        []byte
+}
+
+// idempotencyContextKey is the context key of the idempotencyState of a request.
+type idempotencyContextKey struct{}
+
+// idempotencyState tracks whether the handler made changes that must not be repeated.
+type idempotencyState struct {
+	stored bool
+}
+
+// markIdempotentStored records that the request stored something, such as a broadcast job. Its idempotency key is then
+// kept even when the response is a server error, so a retry can not store it twice.
+func markIdempotentStored(req *http.Request) {
+	if state, ok := req.Context().Value(idempotencyContextKey{}).(*idempotencyState); ok {
+		state.stored = true
+	}
+}
+
+// responseRecorder keeps a copy of the response written to the client.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(data []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	r.body.Write(data)
+	return r.ResponseWriter.Write(data)
+}
+
+// idempotent makes next safe to retry with an Idempotency-Key header. Requests without the header are handled as
+// usual. Server errors are not kept, so they can be retried with the same key, unless the handler already stored
+// something, see markIdempotentStored.
+func (s *Server) idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		key := req.Header.Get(IdempotencyKeyHeader)
+		if key == "" {
+			next(res, req)
+			return
+		}
+		if len(key) > 255 {
+			writeError(res, http.StatusBadRequest, errors.New("idempotency key must not be longer than 255 characters"))
+			return
+		}
+		// keys are per API key, so clients can not replay each other's responses. The id is used rather than the name,
+		// since a revoked key's name can be given to a new key.
+		if apiKey := requestApiKey(req); apiKey != nil {
+			key = strconv.Itoa(apiKey.Id) + ":" + key
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(res, req.Body, MaxBroadcastMediaSize+1<<20))
+		if err != nil {
+			writeError(res, http.StatusBadRequest, errors.Wrap(err, "invalid request body"))
+			return
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		requestHash, err := hashIdempotentRequest(req, body)
+		if err != nil {
+			writeError(res, http.StatusBadRequest, errors.Wrap(err, "invalid request body"))
+			return
+		}
+
+		reservedAt, existing, err := s.reserveIdempotencyKey(req.Context(), key, requestHash)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to reserve idempotency key")
+			res.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if existing != nil {
+			switch {
+			case existing.RequestHash != requestHash:
+				writeError(res, http.StatusUnprocessableEntity, errors.New("idempotency key was used for a different request"))
+			case existing.Status == 0:
+				writeError(res, http.StatusConflict, errors.New("a request with this idempotency key is still being handled"))
+			default:
+				log.Debug().Msgf("Replaying response to idempotency key %s", key)
+				if len(existing.Body) > 0 {
+					res.Header().Set("Content-Type", "application/json")
+				}
+				res.Header().Set("Idempotent-Replayed", "true")
+				res.WriteHeader(existing.Status)
+				_, err := res.Write(existing.Body)
+				if err != nil {
+					log.Error().Err(err).Msg("Failed to write replayed response")
+				}
+			}
+			return
+		}
+
+		recorder := &responseRecorder{ResponseWriter: res}
+		state := &idempotencyState{}
+		next(recorder, req.WithContext(context.WithValue(req.Context(), idempotencyContextKey{}, state)))
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+
+		// keep the outcome even if the client went away, that is when it is most likely to retry
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		// the reservation may have expired and been taken by a retry in the meantime, which then owns the key
+		if recorder.status >= http.StatusInternalServerError && !state.stored {
+			_, err = s.bot.db.Exec(ctx, `DELETE FROM idempotency_key WHERE key = $1 AND created_at = $2`, key, reservedAt)
+		} else {
+			_, err = s.bot.db.Exec(ctx, `
+UPDATE idempotency_key
+SET status = $3,
+    body   = $4
+WHERE key = $1
+  AND created_at = $2`, key, reservedAt, recorder.status, recorder.body.Bytes())
+		}
+		if err != nil {
+			log.Error().Err(err).Msgf("Failed to store outcome of idempotency key %s", key)
+		}
+	}
+}
+
+// hashIdempotentRequest returns a hash of what the request asks for. Multipart bodies are hashed by their fields and
+// files, since clients pick a new boundary each time they send one.
+func hashIdempotentRequest(req *http.Request, body []byte) (string, error) {
+	h := sha256.New()
+	io.WriteString(h, req.Method+" "+req.URL.Path+"\n")
+
+	mediaType, params, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		h.Write(body)
+		return hex.EncodeToString(h.Sum(nil)), nil
+	}
+	reader := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return "", errors.Wrap(err, "failed to read multipart body")
+		}
+		err = hashPart(h, part)
+		if err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashPart adds a field or file of a multipart body to h, with its length so parts can not run into each other.
+func hashPart(h hash.Hash, part *multipart.Part) error {
+	defer part.Close()
+	data, err := io.ReadAll(part)
+	if err != nil {
+		return errors.Wrap(err, "failed to read multipart body")
+	}
+	fmt.Fprintf(h, "%q %q %q %d\n", part.FormName(), part.FileName(), part.Header.Get("Content-Type"), len(data))
+	h.Write(data)
+	return nil
+}
+
+// reserveIdempotencyKey claims the key for the request and returns when it did so. When the key was already used
+// within the window, the stored request is returned instead.
+func (s *Server) reserveIdempotencyKey(ctx context.Context, key string, requestHash string) (time.Time, *idempotentRequest, error) {
+	_, err := s.bot.db.Exec(ctx, `
+DELETE FROM idempotency_key
+WHERE created_at < $1
+   OR (status = 0 AND created_at < $2)`, time.Now().Add(-idempotencyWindow()), time.Now().Add(-idempotencyLease()))
+	if err != nil {
+		return time.Time{}, nil, errors.Wrap(err, "failed to delete expired idempotency keys")
+	}
+
+	var reservedAt time.Time
+	err = s.bot.db.QueryRow(ctx, `
+INSERT INTO idempotency_key (key, request_hash, status)
+VALUES ($1, $2, 0)
+ON CONFLICT DO NOTHING
+RETURNING created_at`, key, requestHash).Scan(&reservedAt)
+	if err == nil {
+		return reservedAt, nil, nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return time.Time{}, nil, errors.Wrap(err, "failed to insert idempotency key")
+	}
+
+	var existing idempotentRequest
+	err = s.bot.db.QueryRow(ctx, `
+SELECT request_hash, status, coalesce(body, '')
+FROM idempotency_key
+WHERE key = $1`, key).Scan(&existing.RequestHash, &existing.Status, &existing.Body)
+	if errors.Is(err, pgx.ErrNoRows) {
+		// the first request failed and released the key in the meantime
+		return s.reserveIdempotencyKey(ctx, key, requestHash)
+	}
+	if err != nil {
+		return time.Time{}, nil, errors.Wrap(err, "failed to get idempotency key")
+	}
+	return time.Time{}, &existing, nil
+}
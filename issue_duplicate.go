@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+const (
+	// DefaultDuplicateWindowDays is how far back open reports are compared against a new report.
+	DefaultDuplicateWindowDays = 7
+	// DefaultDuplicateThreshold is the similarity from which two reports are considered to be about the same issue.
+	DefaultDuplicateThreshold = 0.5
+)
+
+var (
+	supportKeywords   = []string{"dukung", "ikut mendukung", "ya"}
+	newReportKeywords = []string{"baru", "buat baru", "tidak"}
+)
+
+// IssueSimilarity scores how likely two issue reports describe the same issue, from 0 (unrelated) to 1 (the same).
+// The default TokenSimilarity compares words, an embedding based implementation can be plugged in instead.
+type IssueSimilarity interface {
+	Similarity(ctx context.Context, a string, b string) (float64, error)
+}
+
+// TokenSimilarity is the Jaccard similarity of the sets of meaningful words in both texts.
+type TokenSimilarity struct{}
+
+// similarityStopWords are common words that say nothing about the issue itself.
+var similarityStopWords = map[string]bool{
+	"di": true, "ke": true, "dari": true, "yang": true, "dan": true, "ada": true, "ini": true, "itu": true,
+	"sudah": true, "sejak": true, "lokasi": true, "depan": true, "dekat": true, "rumah": true, "saya": true,
+	"tidak": true, "sangat": true, "sekali": true, "rt": true, "rw": true, "no": true, "jalan": true, "jl": true,
+}
+
+func (TokenSimilarity) Similarity(_ context.Context, a string, b string) (float64, error) {
+	tokensA, tokensB := similarityTokens(a), similarityTokens(b)
+	if len(tokensA) == 0 || len(tokensB) == 0 {
+		return 0, nil
+	}
+	intersection := 0
+	for token := range tokensA {
+		if tokensB[token] {
+			intersection++
+		}
+	}
+	union := len(tokensA) + len(tokensB) - intersection
+	return float64(intersection) / float64(union), nil
+}
+
+func similarityTokens(text string) map[string]bool {
+	tokens := map[string]bool{}
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if len(word) > 1 && !similarityStopWords[word] {
+			tokens[word] = true
+		}
+	}
+	return tokens
+}
+
+// OpenIssue is an issue report that has not been resolved yet.
+type OpenIssue struct {
+	IssueReportId int
+	Title         string
+	Description   string
+	Status        string
+}
+
+// Offer is the message asking the resident to support this report instead of creating a new one.
+func (i OpenIssue) Offer() string {
+	return fmt.Sprintf(`Sudah ada laporan serupa dari warga lain:
+*#%d* %s
+*Status*: %s
+
+Ketik *dukung* untuk ikut mendukung laporan tersebut, atau *baru* untuk tetap membuat laporan baru.`, i.IssueReportId, i.Title, i.Status)
+}
+
+// duplicateWindowDays returns DUPLICATE_WINDOW_DAYS, the number of days open reports are compared against.
+func duplicateWindowDays() int {
+	days, err := strconv.Atoi(os.Getenv("DUPLICATE_WINDOW_DAYS"))
+	if err != nil || days <= 0 {
+		return DefaultDuplicateWindowDays
+	}
+	return days
+}
+
+// duplicateThreshold returns DUPLICATE_THRESHOLD, the similarity from which reports are considered duplicates.
+func duplicateThreshold() float64 {
+	threshold, err := strconv.ParseFloat(os.Getenv("DUPLICATE_THRESHOLD"), 64)
+	if err != nil || threshold <= 0 || threshold > 1 {
+		return DefaultDuplicateThreshold
+	}
+	return threshold
+}
+
+// findDuplicateIssue returns the open report from the last few days most similar to draft, or nil when none of them
+// is similar enough. Reports of the sender themselves and rejected reports are not offered.
+func (b *Bot) findDuplicateIssue(ctx context.Context, sender string, draft IssueReportDraft) (*OpenIssue, error) {
+	rows, err := b.db.Query(ctx, `
+SELECT ir.issue_report_id,
+       ir.title,
+       ir.description,
+       ir.status
+FROM issue_report ir
+JOIN resident r ON ir.resident_id = r.resident_id
+WHERE ir.status <> 'Done'
+  AND ir.approval_status IS DISTINCT FROM 'Rejected'
+  AND r.whatsapp_number <> $2
+  AND ir.created_at >= now() - make_interval(days => $1)`, duplicateWindowDays(), sender)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get open issue reports")
+	}
+	defer rows.Close()
+
+	var openIssues []OpenIssue
+	for rows.Next() {
+		var issue OpenIssue
+		err := rows.Scan(
+			&issue.IssueReportId,
+			&issue.Title,
+			&issue.Description,
+			&issue.Status,
+		)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to scan open issue report")
+		}
+		openIssues = append(openIssues, issue)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to read open issue reports")
+	}
+
+	var best *OpenIssue
+	bestScore := duplicateThreshold()
+	text := draft.Title + "\n" + draft.Description + "\n" + draft.Location
+	for i, issue := range openIssues {
+		score, err := b.similarity.Similarity(ctx, text, issue.Title+"\n"+issue.Description)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to compare issue reports")
+		}
+		if score >= bestScore {
+			best, bestScore = &openIssues[i], score
+		}
+	}
+	if best != nil {
+		log.Debug().Msgf("Issue report looks like a duplicate of #%d (similarity %.2f)", best.IssueReportId, bestScore)
+	}
+	return best, nil
+}
+
+// issueReportDuplicateStep returns a step that lets the resident support an existing report instead of filing draft.
+func (b *Bot) issueReportDuplicateStep(draft IssueReportDraft, duplicate OpenIssue) ConversationStep {
+	var step ConversationStep
+	step = func(ctx context.Context, sender string, msg string, evt *events.Message) (string, ConversationStep, error) {
+		switch {
+		case matchesKeyword(msg, supportKeywords):
+			err, reply := handleIssueSupport(ctx, b.db, sender, duplicate.IssueReportId)
+			return reply, nil, err
+		case matchesKeyword(msg, newReportKeywords):
+			reply, next := b.nextIssueReportQuestion(ctx, sender, draft)
+			return reply, next, nil
+		default:
+			return "Ketik *dukung* untuk ikut mendukung laporan tersebut, atau *baru* untuk membuat laporan baru.", step, nil
+		}
+	}
+	return step
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// IssueStatusChannel is the postgres notification channel fed by the issue_report_status_notify trigger.
+const IssueStatusChannel = "issue_report_status"
+
+// IssueStatusChange is the payload of a notification sent on IssueStatusChannel.
+type IssueStatusChange struct {
+	IssueReportId     int    `json:"issue_report_id"`
+	Status            string `json:"status"`
+	OldStatus         string `json:"old_status"`
+	ApprovalStatus    string `json:"approval_status"`
+	OldApprovalStatus string `json:"old_approval_status"`
+	// ChangedAt is the time of the transaction that made the change, no later than its audit entry.
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+// issueStatusTemplates are the messages sent to the reporter when their issue report reaches a status.
+// Each template receives the ticket number and the title of the report.
+var issueStatusTemplates = map[string]string{
+	"To do":       "Laporan Anda *#%d* (%s) sudah kami terima dan menunggu untuk ditindaklanjuti.",
+	"In progress": "Laporan Anda *#%d* (%s) sedang ditindaklanjuti oleh pengurus RW.",
+	"Done":        "Laporan Anda *#%d* (%s) telah selesai ditangani. Terima kasih sudah melapor!",
+}
+
+// Field returns the column of issue_report the change is reported for and its new value, status taking precedence
+// over approval_status.
+func (c IssueStatusChange) Field() (string, string) {
+	if c.Status != c.OldStatus {
+		return "status", c.Status
+	}
+	return "approval_status", c.ApprovalStatus
+}
+
+// Message is the update sent to the reporter for this change, along with the note of the official who made it.
+func (c IssueStatusChange) Message(title string, note string) string {
+	var message string
+	if c.Status != c.OldStatus {
+		if template, ok := issueStatusTemplates[c.Status]; ok {
+			message = fmt.Sprintf(template, c.IssueReportId, title)
+		} else {
+			message = fmt.Sprintf("Status laporan Anda *#%d* (%s) berubah menjadi *%s*.", c.IssueReportId, title, c.Status)
+		}
+	} else {
+		message = fmt.Sprintf("Persetujuan laporan Anda *#%d* (%s) berubah menjadi *%s*.", c.IssueReportId, title, c.ApprovalStatus)
+	}
+	if note != "" {
+		message += "\n\n*Catatan pengurus*: " + note
+	}
+	return message
+}
+
+// listenIssueStatusChanges listens for issue report status changes and forwards them to the residents who reported
+// them, until ctx is done. The listening connection is re-established whenever it is lost.
+func (b *Bot) listenIssueStatusChanges(ctx context.Context) {
+	for {
+		err := b.waitIssueStatusChanges(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Error().Err(err).Msg("Lost issue status listener, reconnecting")
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+func (b *Bot) waitIssueStatusChanges(ctx context.Context) error {
+	conn, err := b.db.Acquire(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to acquire connection")
+	}
+	defer conn.Release()
+
+	_, err = conn.Exec(ctx, "LISTEN "+IssueStatusChannel)
+	if err != nil {
+		return errors.Wrap(err, "failed to listen to issue status channel")
+	}
+	log.Debug().Msgf("Listening to %s notifications", IssueStatusChannel)
+
+	for {
+		notification, err := conn.Conn().WaitForNotification(ctx)
+		if err != nil {
+			return errors.Wrap(err, "failed to wait for notification")
+		}
+
+		var change IssueStatusChange
+		err = json.Unmarshal([]byte(notification.Payload), &change)
+		if err != nil {
+			log.Error().Err(err).Msgf("Failed to decode issue status notification: %s", notification.Payload)
+			continue
+		}
+
+		err = b.notifyIssueStatusChange(ctx, change)
+		if err != nil {
+			log.Error().Err(err).Msgf("Failed to notify status change of issue report %d", change.IssueReportId)
+		}
+	}
+}
+
+// notifyIssueStatusChange sends the status update of an issue report to the resident who reported it. The note is
+// taken from the first audit entry recording the same change at or after it was made, since officials acting from
+// whatsapp write it after the update.
+func (b *Bot) notifyIssueStatusChange(ctx context.Context, change IssueStatusChange) error {
+	log.Debug().Msgf("Issue report %d changed to %s/%s", change.IssueReportId, change.Status, change.ApprovalStatus)
+
+	field, value := change.Field()
+	var number, title, note string
+	err := b.db.QueryRow(ctx, `
+SELECT r.whatsapp_number,
+       issue_report.title,
+       coalesce((SELECT note
+                 FROM issue_report_audit a
+                 WHERE a.issue_report_id = issue_report.issue_report_id
+                   AND a.field = $3
+                   AND a.new_value = $4
+                   AND a.created_at >= $2
+                 ORDER BY a.created_at
+                 LIMIT 1), '')
+FROM issue_report
+JOIN resident r on issue_report.resident_id = r.resident_id
+WHERE issue_report_id = $1`, change.IssueReportId, change.ChangedAt, field, value).Scan(&number, &title, &note)
+	if err != nil {
+		return errors.Wrap(err, "failed to get reporter of issue report")
+	}
+	if number == "" {
+		return errors.New("reporter has no whatsapp number")
+	}
+
+	sendCtx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	err = b.sendText(sendCtx, number, change.Message(title, note))
+	if err != nil {
+		return err
+	}
+
+	// ask for feedback once the issue is resolved
+	if change.Status == "Done" && change.OldStatus != "Done" {
+		return b.startIssueSurvey(sendCtx, number, change.IssueReportId)
+	}
+	return nil
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// IssueReportDraft holds the fields of an issue report while they are collected across several messages.
+type IssueReportDraft struct {
+	Title       string
+	Description string
+	Location    string
+	Since       string
+	// Latitude and Longitude are set when the resident sends a location pin, in which case HasCoordinates is true.
+	Latitude       float64
+	Longitude      float64
+	HasCoordinates bool
+	// Photo is the downloaded photo of the issue. It is written to the media store under PhotoName when the report
+	// is submitted, and PhotoPath is where it ended up.
+	Photo         []byte
+	PhotoMimeType string
+	PhotoName     string
+	PhotoPath     string
+	// PhotoAsked is set once the resident has been asked for a photo, since the photo is optional.
+	PhotoAsked bool
+	// DuplicateChecked is set once open reports have been searched for the same issue.
+	DuplicateChecked bool
+	// Category, Urgency and AffectedRT are classified by gemini to help admins triage the report. They are left empty
+	// (zero for AffectedRT) when gemini gave no valid value.
+	Category   string
+	Urgency    string
+	AffectedRT int
+	// Reply is the thank-you message sent once the report is submitted.
+	Reply string
+}
+
+// IssueCategories are the valid values of issue_report.category.
+var IssueCategories = []string{"infrastruktur", "keamanan", "kebersihan", "sosial"}
+
+// IssueUrgencies are the valid values of issue_report.urgency, from the least to the most urgent.
+var IssueUrgencies = []string{"rendah", "sedang", "tinggi", "darurat"}
+
+var (
+	confirmKeywords = []string{"ya", "y", "iya", "yes", "kirim"}
+	rejectKeywords  = []string{"tidak", "t", "tdk", "no", "gak", "nggak"}
+	skipKeywords    = []string{"lewati", "skip", "tidak ada", "tidak", "gak ada"}
+)
+
+// issueReportDraftFromMeta builds a draft from the meta gemini extracted from the resident's message.
+func issueReportDraftFromMeta(reply string, meta map[string]interface{}) IssueReportDraft {
+	draft := IssueReportDraft{
+		Title:       metaString(meta, "title"),
+		Description: metaString(meta, "description"),
+		Location:    metaString(meta, "location"),
+		Since:       metaString(meta, "since"),
+		Category:    metaEnum(meta, "category", IssueCategories),
+		Urgency:     metaEnum(meta, "urgency", IssueUrgencies),
+		AffectedRT:  metaRT(meta, "rt"),
+		Reply:       reply,
+	}
+	if draft.Title == "" && draft.Description != "" {
+		draft.Title = issueReportTitle(draft.Description)
+	}
+	return draft
+}
+
+// metaString returns meta[key] as a trimmed string, or an empty string when it is missing or not a string.
+func metaString(meta map[string]interface{}, key string) string {
+	value, _ := meta[key].(string)
+	return strings.TrimSpace(value)
+}
+
+// metaEnum returns meta[key] when it is one of values, or an empty string otherwise.
+func metaEnum(meta map[string]interface{}, key string, values []string) string {
+	value := strings.ToLower(metaString(meta, key))
+	for _, valid := range values {
+		if value == valid {
+			return value
+		}
+	}
+	return ""
+}
+
+// metaRT returns the RT number in meta[key], given either as a number or as text such as "RT 03". It returns zero
+// when there is no valid RT number.
+func metaRT(meta map[string]interface{}, key string) int {
+	switch value := meta[key].(type) {
+	case float64:
+		if value >= 1 && value <= 999 && value == float64(int(value)) {
+			return int(value)
+		}
+	case string:
+		digits := strings.TrimLeft(strings.ToUpper(strings.TrimSpace(value)), "RT. ")
+		rt, err := strconv.Atoi(digits)
+		if err == nil && rt >= 1 && rt <= 999 {
+			return rt
+		}
+	}
+	return 0
+}
+
+// FullDescription is the description stored in issue_report, including the location and time of the issue.
+func (d IssueReportDraft) FullDescription() string {
+	return fmt.Sprintf("%s\n\nLokasi: %s\nSejak: %s", d.Description, d.Location, d.Since)
+}
+
+// Summary is the summary of the draft sent back to the resident for confirmation.
+func (d IssueReportDraft) Summary() string {
+	photo := "tidak ada"
+	if len(d.Photo) > 0 {
+		photo = "terlampir"
+	}
+	var triage strings.Builder
+	if d.Category != "" {
+		triage.WriteString("\n*Kategori*: " + d.Category)
+	}
+	if d.Urgency != "" {
+		triage.WriteString("\n*Urgensi*: " + d.Urgency)
+	}
+	if d.AffectedRT != 0 {
+		triage.WriteString(fmt.Sprintf("\n*RT*: %02d", d.AffectedRT))
+	}
+	return fmt.Sprintf(`*Ringkasan laporan Anda*:
+*Judul*: %s
+*Masalah*: %s
+*Lokasi*: %s
+*Sejak*: %s
+*Foto*: %s%s
+
+Kirim laporan ini? (ya/tidak)`, d.Title, d.Description, d.Location, d.Since, photo, triage.String())
+}
+
+// startIssueReportForm starts collecting the missing fields of draft from the resident, and returns the first question.
+func (b *Bot) startIssueReportForm(ctx context.Context, sender string, draft IssueReportDraft) string {
+	reply, next := b.nextIssueReportQuestion(ctx, sender, draft)
+	b.startConversation(sender, "issue_report", next)
+	return reply
+}
+
+// nextIssueReportQuestion returns the question for the first missing field of draft and the step that handles its
+// answer. Once every field is filled, it returns the summary and the confirmation step.
+func (b *Bot) nextIssueReportQuestion(ctx context.Context, sender string, draft IssueReportDraft) (string, ConversationStep) {
+	switch {
+	case draft.Description == "":
+		return "Masalah apa yang ingin Anda laporkan? Ceritakan sejelas mungkin.", b.issueReportAnswerStep(draft, func(d *IssueReportDraft, answer string) {
+			d.Description = answer
+			if d.Title == "" {
+				d.Title = issueReportTitle(answer)
+			}
+		})
+	case draft.Location == "":
+		return "Di mana lokasi masalahnya? Contoh: depan rumah No. 12, RT 03. Anda juga bisa mengirim lokasi (share location).", b.issueReportLocationStep(draft)
+	case !draft.DuplicateChecked:
+		draft.DuplicateChecked = true
+		duplicate, err := b.findDuplicateIssue(ctx, sender, draft)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to look for duplicate issue reports")
+		}
+		if duplicate == nil {
+			return b.nextIssueReportQuestion(ctx, sender, draft)
+		}
+		return duplicate.Offer(), b.issueReportDuplicateStep(draft, *duplicate)
+	case draft.Since == "":
+		return "Sejak kapan masalah ini terjadi? Contoh: sejak kemarin sore.", b.issueReportAnswerStep(draft, func(d *IssueReportDraft, answer string) {
+			d.Since = answer
+		})
+	case !draft.PhotoAsked:
+		return "Jika ada, kirim foto masalahnya. Ketik *lewati* jika tidak ada foto.", b.issueReportPhotoStep(draft)
+	default:
+		return draft.Summary(), b.issueReportConfirmStep(draft)
+	}
+}
+
+// issueReportAnswerStep returns a step that stores the resident's text answer with set, then asks the next question.
+func (b *Bot) issueReportAnswerStep(draft IssueReportDraft, set func(d *IssueReportDraft, answer string)) ConversationStep {
+	var step ConversationStep
+	step = func(ctx context.Context, sender string, msg string, evt *events.Message) (string, ConversationStep, error) {
+		answer := strings.TrimSpace(msg)
+		if answer == "" {
+			return "Mohon jawab dengan teks, atau ketik *batal* untuk membatalkan laporan.", step, nil
+		}
+		set(&draft, answer)
+		reply, next := b.nextIssueReportQuestion(ctx, sender, draft)
+		return reply, next, nil
+	}
+	return step
+}
+
+// issueReportLocationStep returns a step that accepts the location of the issue, either as text or a location pin.
+func (b *Bot) issueReportLocationStep(draft IssueReportDraft) ConversationStep {
+	var step ConversationStep
+	step = func(ctx context.Context, sender string, msg string, evt *events.Message) (string, ConversationStep, error) {
+		draft.attachLocation(evt)
+		if draft.Location == "" {
+			draft.Location = strings.TrimSpace(msg)
+		}
+		if draft.Location == "" {
+			return "Mohon tuliskan lokasinya atau kirim lokasi, atau ketik *batal* untuk membatalkan laporan.", step, nil
+		}
+		reply, next := b.nextIssueReportQuestion(ctx, sender, draft)
+		return reply, next, nil
+	}
+	return step
+}
+
+// issueReportPhotoStep returns a step that accepts an optional photo of the issue.
+func (b *Bot) issueReportPhotoStep(draft IssueReportDraft) ConversationStep {
+	var step ConversationStep
+	step = func(ctx context.Context, sender string, msg string, evt *events.Message) (string, ConversationStep, error) {
+		if evt.Message.GetImageMessage() != nil {
+			err := b.attachPhoto(&draft, evt)
+			if err != nil {
+				log.Error().Err(err).Msg("Failed to download issue report photo")
+				return "Maaf, foto gagal diterima. Silakan kirim ulang, atau ketik *lewati*.", step, nil
+			}
+		} else if !matchesKeyword(msg, skipKeywords) {
+			return "Kirim foto masalahnya, atau ketik *lewati* jika tidak ada foto.", step, nil
+		}
+		draft.PhotoAsked = true
+		reply, next := b.nextIssueReportQuestion(ctx, sender, draft)
+		return reply, next, nil
+	}
+	return step
+}
+
+// issueReportConfirmStep returns a step that submits the report once the resident confirms the summary.
+func (b *Bot) issueReportConfirmStep(draft IssueReportDraft) ConversationStep {
+	var step ConversationStep
+	step = func(ctx context.Context, sender string, msg string, evt *events.Message) (string, ConversationStep, error) {
+		switch {
+		case matchesKeyword(msg, confirmKeywords):
+			if len(draft.Photo) > 0 {
+				path, err := b.media.Save(ctx, "issue_report/"+draft.PhotoName, draft.PhotoMimeType, draft.Photo)
+				if err != nil {
+					return "", nil, errors.Wrap(err, "failed to store issue report photo")
+				}
+				draft.PhotoPath = path
+			}
+			err, issueReportId, reply := handleIssueReport(ctx, b.db, sender, draft)
+			if err != nil {
+				return "", nil, err
+			}
+			go b.notifyOfficials(issueReportId)
+			return reply, nil, nil
+		case matchesKeyword(msg, rejectKeywords):
+			return "Baik, laporan Anda tidak dikirim.", nil, nil
+		default:
+			return "Ketik *ya* untuk mengirim laporan, atau *tidak* untuk membatalkan.", step, nil
+		}
+	}
+	return step
+}
+
+// issueReportTitle derives a short title from the resident's description of the issue.
+func issueReportTitle(description string) string {
+	title := strings.SplitN(description, "\n", 2)[0]
+	if runes := []rune(title); len(runes) > 60 {
+		title = strings.TrimSpace(string(runes[:60])) + "..."
+	}
+	return title
+}
+
+// attachPhoto downloads the image of evt into the draft.
+func (b *Bot) attachPhoto(draft *IssueReportDraft, evt *events.Message) error {
+	image := evt.Message.GetImageMessage()
+	data, err := b.downloadMedia(image)
+	if err != nil {
+		return err
+	}
+	draft.setPhoto(data, image.GetMimetype(), evt.Info.ID)
+	return nil
+}
+
+// setPhoto attaches a downloaded photo to the draft, so the resident is not asked for one anymore.
+func (d *IssueReportDraft) setPhoto(data []byte, mimeType string, name string) {
+	d.Photo = data
+	d.PhotoMimeType = mimeType
+	d.PhotoName = name
+	d.PhotoAsked = true
+}
+
+// attachLocation stores the coordinates of the location pin in evt, if it is one. The name or address of the pinned
+// place is used as the location description when the resident has not given one.
+func (d *IssueReportDraft) attachLocation(evt *events.Message) {
+	location := evt.Message.GetLocationMessage()
+	if location == nil {
+		return
+	}
+	d.Latitude = location.GetDegreesLatitude()
+	d.Longitude = location.GetDegreesLongitude()
+	d.HasCoordinates = true
+	if d.Location == "" {
+		d.Location = strings.TrimSpace(strings.Join([]string{location.GetName(), location.GetAddress()}, " "))
+	}
+	if d.Location == "" {
+		d.Location = strconv.FormatFloat(d.Latitude, 'f', 6, 64) + ", " + strconv.FormatFloat(d.Longitude, 'f', 6, 64)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// DefaultSurveyTimeout is how long the reporter can take to rate a resolved issue.
+const DefaultSurveyTimeout = 24 * time.Hour
+
+// surveyTimeout returns SURVEY_TIMEOUT, how long the bot waits for the reporter's rating.
+func surveyTimeout() time.Duration {
+	timeout, err := time.ParseDuration(os.Getenv("SURVEY_TIMEOUT"))
+	if err != nil || timeout <= 0 {
+		return DefaultSurveyTimeout
+	}
+	return timeout
+}
+
+// startIssueSurvey asks the reporter of a resolved issue to rate how it was handled. The survey is skipped when the
+// reporter is already in the middle of another conversation, so it does not hijack their answer.
+func (b *Bot) startIssueSurvey(ctx context.Context, number string, issueReportId int) error {
+	if _, ok := b.conversations.Get(number); ok {
+		log.Debug().Msgf("Skipping survey of issue report %d, %s is in another conversation", issueReportId, number)
+		return nil
+	}
+
+	b.conversations.SetWithTimeout(number, "issue_survey", b.issueSurveyStep(issueReportId), surveyTimeout())
+	return b.sendText(ctx, number, fmt.Sprintf(`Seberapa puas Anda dengan penanganan laporan *#%d*?
+Balas dengan angka *1* (sangat tidak puas) sampai *5* (sangat puas).`, issueReportId))
+}
+
+// issueSurveyStep returns a step that stores the reporter's 1-5 rating of an issue report. Any other message ends the
+// survey and is handled as usual, so the reporter is not stuck answering it.
+func (b *Bot) issueSurveyStep(issueReportId int) ConversationStep {
+	return func(ctx context.Context, sender string, msg string, evt *events.Message) (string, ConversationStep, error) {
+		rating, err := strconv.Atoi(strings.TrimSpace(msg))
+		if err != nil || rating < 1 || rating > 5 {
+			return "", nil, ErrNotAnAnswer
+		}
+		err, reply := handleIssueRating(ctx, b.db, sender, issueReportId, rating)
+		return reply, nil, err
+	}
+}
+
+// handleIssueRating stores the reporter's rating of a resolved issue report.
+func handleIssueRating(ctx context.Context, db *pgxpool.Pool, sender string, issueReportId int, rating int) (error, string) {
+	log.Debug().Msgf("Handling rating %d from %s for issue report %d", rating, sender, issueReportId)
+	_, err := db.Exec(ctx, `
+INSERT INTO issue_report_rating (issue_report_id, resident_id, rating)
+SELECT $1, resident_id, $3
+FROM resident
+WHERE whatsapp_number = $2
+ON CONFLICT (issue_report_id) DO UPDATE SET rating = excluded.rating, created_at = now()`, issueReportId, sender, rating)
+	if err != nil {
+		return errors.Wrap(err, "failed to insert issue report rating"), ""
+	}
+	return nil, "Terima kasih atas penilaian Anda!"
+}
+
+// SatisfactionSummary is the aggregate of the ratings residents gave to resolved issue reports.
+type SatisfactionSummary struct {
+	Category string         `json:"category"`
+	Count    int            `json:"count"`
+	Average  float64        `json:"average"`
+	Ratings  map[string]int `json:"ratings"`
+}
+
+// getSatisfactionSummary aggregates the ratings of the last days days, overall and per issue category.
+func getSatisfactionSummary(ctx context.Context, db *pgxpool.Pool, days int) ([]SatisfactionSummary, error) {
+	rows, err := db.Query(ctx, `
+SELECT coalesce(ir.category, 'lainnya'),
+       rating,
+       count(*)
+FROM issue_report_rating rating
+JOIN issue_report ir on rating.issue_report_id = ir.issue_report_id
+WHERE rating.created_at >= now() - make_interval(days => $1)
+GROUP BY 1, 2`, days)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get issue report ratings")
+	}
+	defer rows.Close()
+
+	overall := &SatisfactionSummary{Category: "semua", Ratings: map[string]int{}}
+	byCategory := map[string]*SatisfactionSummary{}
+	var categories []string
+	for rows.Next() {
+		var category string
+		var rating, count int
+		err := rows.Scan(&category, &rating, &count)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to scan issue report ratings")
+		}
+		summary, ok := byCategory[category]
+		if !ok {
+			summary = &SatisfactionSummary{Category: category, Ratings: map[string]int{}}
+			byCategory[category] = summary
+			categories = append(categories, category)
+		}
+		for _, s := range []*SatisfactionSummary{overall, summary} {
+			s.Ratings[strconv.Itoa(rating)] += count
+			s.Average = (s.Average*float64(s.Count) + float64(rating*count)) / float64(s.Count+count)
+			s.Count += count
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to read issue report ratings")
+	}
+
+	summaries := []SatisfactionSummary{*overall}
+	for _, category := range categories {
+		summaries = append(summaries, *byCategory[category])
+	}
+	return summaries, nil
+}
+
+// handleSatisfactionRequest formats the satisfaction summary of the last 30 days for officials.
+func handleSatisfactionRequest(ctx context.Context, db *pgxpool.Pool) (error, string) {
+	summaries, err := getSatisfactionSummary(ctx, db, 30)
+	if err != nil {
+		return err, ""
+	}
+	if summaries[0].Count == 0 {
+		return nil, "Belum ada penilaian dari warga dalam 30 hari terakhir."
+	}
+
+	var sb strings.Builder
+	sb.WriteString("*Kepuasan warga 30 hari terakhir*:\n")
+	for _, summary := range summaries {
+		sb.WriteString(fmt.Sprintf("\n*%s*: %.1f/5 dari %d penilaian", summary.Category, summary.Average, summary.Count))
+	}
+	return nil, sb.String()
+}
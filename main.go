@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"github.com/allegro/bigcache"
 	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pkg/errors"
 	"os"
 	"os/signal"
 	"syscall"
@@ -60,32 +61,49 @@ func App() *cli.App {
 					ctxWithTimeout, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 					defer cancel()
 
-					dbUrl := os.Getenv("DATABASE_URL")
-					if dbUrl == "" {
-						log.Fatal().Msg("DATABASE_URL is not set")
-					}
-
-					conn, err := pgxpool.New(ctxWithTimeout, dbUrl)
+					conn, err := openDatabase(ctxWithTimeout)
 					if err != nil {
-						log.Fatal().Err(err).Msg(fmt.Sprintf("Unable to connect to database: %v\n", err))
+						log.Fatal().Err(err).Msg("Failed to open database")
 					}
 					defer conn.Close()
 
 					clientLog := waLog.Stdout("Client", "DEBUG", true)
+					client := whatsmeow.NewClient(deviceStore, clientLog)
 					bot := &Bot{
-						client: whatsmeow.NewClient(deviceStore, clientLog),
-						cache:  cache,
-						db:     conn,
+						client:        client,
+						outbox:        NewOutbox(conn, client, NewDispatcher(client, NewDispatcherConfig())),
+						cache:         cache,
+						db:            conn,
+						conversations: NewConversationStore(),
+						media:         NewLocalMediaStore(os.Getenv("MEDIA_DIR")),
+						transcriber:   NewTranscriber(),
+						similarity:    TokenSimilarity{},
 					}
 					bot.RegisterHandlers()
 
+					err = bot.outbox.ReleaseClaimed(ctxWithTimeout)
+					if err != nil {
+						log.Fatal().Err(err).Msg("Failed to release outbox messages")
+					}
+
+					broadcaster := NewBroadcaster(bot)
 					server := &Server{
-						bot: bot,
+						bot:         bot,
+						broadcaster: broadcaster,
 					}
 
 					var signalChan = make(chan os.Signal, 1)
 					signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
 
+					// background workers stop once the app receives a signal
+					workerCtx, stopWorkers := context.WithCancel(context.Background())
+					defer stopWorkers()
+
+					go bot.listenIssueStatusChanges(workerCtx)
+					go broadcaster.Run(workerCtx)
+					go broadcaster.RunScheduler(workerCtx)
+					go bot.outbox.Run(workerCtx)
+
 					go func() {
 						if err := bot.Start(); err != nil {
 							log.Fatal().Err(err).Msg("Failed to start bot")
@@ -104,10 +122,31 @@ func App() *cli.App {
 					return nil
 				},
 			},
+			apiKeyCommand(),
 		},
 	}
 }
 
+// openDatabase connects to the RWIS database and applies the gateway's schema changes.
+func openDatabase(ctx context.Context) (*pgxpool.Pool, error) {
+	dbUrl := os.Getenv("DATABASE_URL")
+	if dbUrl == "" {
+		return nil, errors.New("DATABASE_URL is not set")
+	}
+
+	conn, err := pgxpool.New(ctx, dbUrl)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to connect to database")
+	}
+
+	err = migrate(ctx, conn)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "failed to migrate database")
+	}
+	return conn, nil
+}
+
 func main() {
 	if err := App().Run(os.Args); err != nil {
 		log.Fatal().Err(err).Msg("Failed to run app")
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.mau.fi/whatsmeow"
+)
+
+// DefaultMediaDir is the directory media is stored in when MEDIA_DIR is not set.
+const DefaultMediaDir = "media"
+
+// MediaStore stores media downloaded from whatsapp, such as photos attached to issue reports.
+type MediaStore interface {
+	// Save stores data under name and returns the location it can be retrieved from later.
+	Save(ctx context.Context, name string, mimeType string, data []byte) (string, error)
+}
+
+// LocalMediaStore is a MediaStore that keeps media as files in a local directory.
+type LocalMediaStore struct {
+	Dir string
+}
+
+func NewLocalMediaStore(dir string) *LocalMediaStore {
+	if dir == "" {
+		dir = DefaultMediaDir
+	}
+	return &LocalMediaStore{Dir: dir}
+}
+
+func (s *LocalMediaStore) Save(_ context.Context, name string, mimeType string, data []byte) (string, error) {
+	if filepath.Ext(name) == "" {
+		name += mediaExtension(mimeType)
+	}
+	path := filepath.Join(s.Dir, filepath.Clean("/"+name))
+	err := os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create media directory")
+	}
+	err = os.WriteFile(path, data, 0o644)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to write media file")
+	}
+	return path, nil
+}
+
+// mediaExtension returns the file extension for a mime type, or an empty string if it is unknown.
+func mediaExtension(mimeType string) string {
+	mimeType = strings.TrimSpace(strings.Split(mimeType, ";")[0])
+	switch mimeType {
+	case "image/jpeg":
+		return ".jpg"
+	case "audio/ogg":
+		return ".ogg"
+	}
+	extensions, err := mime.ExtensionsByType(mimeType)
+	if err != nil || len(extensions) == 0 {
+		return ""
+	}
+	return extensions[0]
+}
+
+// downloadMedia downloads the media of a whatsapp message, such as an image or audio message.
+func (b *Bot) downloadMedia(msg whatsmeow.DownloadableMessage) ([]byte, error) {
+	data, err := b.client.Download(msg)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to download media")
+	}
+	return data, nil
+}
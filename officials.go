@@ -0,0 +1,404 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+const (
+	// OfficialRoleRT is the role of an RT head, who is notified about reports from households in their RT.
+	OfficialRoleRT = "rt"
+	// OfficialRoleRW is the role of an RW official, who can act on reports from every RT.
+	OfficialRoleRW = "rw"
+)
+
+// Official is an RT or RW official allowed to act on issue reports from whatsapp.
+type Official struct {
+	WhatsappNumber string
+	Name           string
+	Role           string
+	// RT is the RT an RT head is responsible for. It is zero for RW officials.
+	RT int
+}
+
+// CanManage reports whether the official is allowed to act on a report from a household in rt. Reports whose RT is not
+// known, rt being zero, are left to RW officials.
+func (o Official) CanManage(rt int) bool {
+	return o.Role == OfficialRoleRW || (o.Role == OfficialRoleRT && rt != 0 && o.RT == rt)
+}
+
+// getOfficial returns the official with the given whatsapp number, or false if the number does not belong to one.
+func getOfficial(ctx context.Context, db *pgxpool.Pool, number string) (Official, bool, error) {
+	var official Official
+	var rt *int
+	err := db.QueryRow(ctx, `
+SELECT whatsapp_number,
+       name,
+       role,
+       rt
+FROM official
+WHERE whatsapp_number = $1`, number).Scan(
+		&official.WhatsappNumber,
+		&official.Name,
+		&official.Role,
+		&rt,
+	)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return Official{}, false, nil
+	}
+	if err != nil {
+		return Official{}, false, errors.Wrap(err, "failed to get official")
+	}
+	if rt != nil {
+		official.RT = *rt
+	}
+	return official, true, nil
+}
+
+var nonDigits = regexp.MustCompile(`\D`)
+
+// parseRT extracts the RT number from the rt column of household, such as "03" or "RT 003".
+func parseRT(rt string) int {
+	number, err := strconv.Atoi(nonDigits.ReplaceAllString(rt, ""))
+	if err != nil {
+		return 0
+	}
+	return number
+}
+
+// formatRT formats an RT parsed with parseRT for messages to officials.
+func formatRT(rt int) string {
+	if rt == 0 {
+		return "RT tidak diketahui"
+	}
+	return fmt.Sprintf("RT %02d", rt)
+}
+
+// NewIssueReport is the summary of a newly filed issue report sent to officials.
+type NewIssueReport struct {
+	IssueReportId int
+	Title         string
+	Description   string
+	Category      string
+	Urgency       string
+	ReporterName  string
+	// ReporterRT is zero when the RT of the reporter is not known, e.g. because they are not in a household.
+	ReporterRT int
+}
+
+// Message is the notification sent to officials about the report, with the quick actions they can reply with.
+func (r NewIssueReport) Message() string {
+	var triage strings.Builder
+	if r.Category != "" {
+		triage.WriteString("\n*Kategori*: " + r.Category)
+	}
+	if r.Urgency != "" {
+		triage.WriteString("\n*Urgensi*: " + r.Urgency)
+	}
+	return fmt.Sprintf(`*Laporan baru #%d*
+*Judul*: %s
+*Pelapor*: %s (%s)%s
+*Masalah*: %s
+
+Balas *setujui %d* untuk menyetujui laporan ini, atau *tolak %d <catatan>* untuk menolaknya.`,
+		r.IssueReportId,
+		r.Title,
+		r.ReporterName,
+		formatRT(r.ReporterRT),
+		triage.String(),
+		r.Description,
+		r.IssueReportId,
+		r.IssueReportId)
+}
+
+// adminGroup returns the admin whatsapp group configured with ADMIN_GROUP_JID, or false if there is none.
+func adminGroup() (types.JID, bool) {
+	group := os.Getenv("ADMIN_GROUP_JID")
+	if group == "" {
+		return types.JID{}, false
+	}
+	jid, err := types.ParseJID(group)
+	if err != nil {
+		log.Error().Err(err).Msg("ADMIN_GROUP_JID is not a valid JID")
+		return types.JID{}, false
+	}
+	return jid, true
+}
+
+// notifyOfficials tells the RT head of the reporter's household and the admin group about a new issue report. When
+// the RT of the reporter is not known, only the admin group is told.
+func (b *Bot) notifyOfficials(issueReportId int) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	var report NewIssueReport
+	var category, urgency, rt *string
+	err := b.db.QueryRow(ctx, `
+SELECT issue_report_id,
+       title,
+       description,
+       category,
+       urgency,
+       r.full_name,
+       h.rt
+FROM issue_report
+JOIN resident r on issue_report.resident_id = r.resident_id
+LEFT JOIN household h on r.household_id = h.household_id
+WHERE issue_report_id = $1`, issueReportId).Scan(
+		&report.IssueReportId,
+		&report.Title,
+		&report.Description,
+		&category,
+		&urgency,
+		&report.ReporterName,
+		&rt,
+	)
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed to get issue report %d for officials", issueReportId)
+		return
+	}
+	if category != nil {
+		report.Category = *category
+	}
+	if urgency != nil {
+		report.Urgency = *urgency
+	}
+	if rt != nil {
+		report.ReporterRT = parseRT(*rt)
+	}
+	message := report.Message()
+
+	if report.ReporterRT != 0 {
+		b.notifyRTHeads(ctx, report.ReporterRT, issueReportId, message)
+	}
+
+	if group, ok := adminGroup(); ok {
+		err := b.sendSplit(ctx, group, message, nil)
+		if err != nil {
+			log.Error().Err(err).Msgf("Failed to notify admin group about issue report %d", issueReportId)
+		}
+	}
+}
+
+// notifyRTHeads sends the notification about a new issue report to the heads of rt.
+func (b *Bot) notifyRTHeads(ctx context.Context, rt int, issueReportId int, message string) {
+	rows, err := b.db.Query(ctx, `
+SELECT whatsapp_number
+FROM official
+WHERE role = $1
+  AND rt = $2`, OfficialRoleRT, rt)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get RT heads")
+		return
+	}
+	numbers, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to scan RT heads")
+		return
+	}
+
+	for _, number := range numbers {
+		err := b.sendText(ctx, number, message)
+		if err != nil {
+			log.Error().Err(err).Msgf("Failed to notify RT head %s about issue report %d", number, issueReportId)
+		}
+	}
+}
+
+// IssueAction is a change officials can make to an issue report from whatsapp.
+type IssueAction struct {
+	// Column is the column of issue_report the action changes, either status or approval_status.
+	Column string
+	Value  string
+}
+
+// issueActions are the actions officials can reply with, keyed by their command.
+var issueActions = map[string]IssueAction{
+	"setujui": {Column: "approval_status", Value: "Approved"},
+	"tolak":   {Column: "approval_status", Value: "Rejected"},
+	"proses":  {Column: "status", Value: "In progress"},
+	"selesai": {Column: "status", Value: "Done"},
+}
+
+var (
+	// adminCommandPattern matches the actions officials reply with, such as "setujui 123" or "tolak 123 bukan wilayah RW".
+	adminCommandPattern = regexp.MustCompile(`(?is)^\s*(setujui|tolak|proses|selesai)\s+#?(\d+)(?:\s+(.+?))?\s*$`)
+	// pendingCommandPattern matches the command listing the reports waiting for approval.
+	pendingCommandPattern = regexp.MustCompile(`(?i)^\s*(laporan\s+)?pending\s*$`)
+	// satisfactionCommandPattern matches the command showing how satisfied residents are with resolved reports.
+	satisfactionCommandPattern = regexp.MustCompile(`(?i)^\s*(laporan\s+)?kepuasan\s*$`)
+)
+
+// handleAdminCommand handles the commands officials send, either in a private chat or in the admin group.
+// It returns false when the message is not an admin command, or the sender is not an official.
+func (b *Bot) handleAdminCommand(sender string, msg string, evt *events.Message) bool {
+	match := adminCommandPattern.FindStringSubmatch(msg)
+	pending := pendingCommandPattern.MatchString(msg)
+	satisfaction := satisfactionCommandPattern.MatchString(msg)
+	if match == nil && !pending && !satisfaction {
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	evt.Info.Sender.Device = 0
+
+	official, ok, err := getOfficial(ctx, b.db, sender)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to check official")
+		return false
+	}
+	if !ok {
+		return false
+	}
+
+	var reply string
+	switch {
+	case pending:
+		log.Debug().Msgf("Handling pending command from official %s", sender)
+		err, reply = handlePendingIssuesRequest(ctx, b.db, official)
+	case satisfaction:
+		log.Debug().Msgf("Handling satisfaction command from official %s", sender)
+		err, reply = handleSatisfactionRequest(ctx, b.db)
+	default:
+		command := strings.ToLower(match[1])
+		issueReportId, _ := strconv.Atoi(match[2])
+		log.Debug().Msgf("Handling %s command from official %s for issue report %d", command, sender, issueReportId)
+		err, reply = handleIssueAction(ctx, b.db, official, issueReportId, issueActions[command], strings.TrimSpace(match[3]))
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to handle admin command")
+		reply = "Maaf, perintah tidak dapat diproses saat ini."
+	}
+
+	err = b.sendReply(ctx, evt, "admin_command", reply)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to send message")
+	}
+	return true
+}
+
+// handlePendingIssuesRequest lists the issue reports waiting for approval that the official is responsible for.
+func handlePendingIssuesRequest(ctx context.Context, db *pgxpool.Pool, official Official) (error, string) {
+	rows, err := db.Query(ctx, `
+SELECT issue_report_id,
+       title,
+       r.full_name,
+       h.rt
+FROM issue_report
+JOIN resident r on issue_report.resident_id = r.resident_id
+LEFT JOIN household h on r.household_id = h.household_id
+WHERE approval_status = 'Pending'
+ORDER BY issue_report_id`)
+	if err != nil {
+		return errors.Wrap(err, "failed to get pending issue reports"), ""
+	}
+	defer rows.Close()
+
+	var sb strings.Builder
+	count := 0
+	for rows.Next() {
+		var issueReportId int
+		var title, reporter string
+		var rt *string
+		err := rows.Scan(&issueReportId, &title, &reporter, &rt)
+		if err != nil {
+			return errors.Wrap(err, "failed to scan pending issue report"), ""
+		}
+		reporterRT := 0
+		if rt != nil {
+			reporterRT = parseRT(*rt)
+		}
+		if !official.CanManage(reporterRT) {
+			continue
+		}
+		count++
+		sb.WriteString(fmt.Sprintf("*#%d* %s\n*Pelapor*: %s (%s)\n\n", issueReportId, title, reporter, formatRT(reporterRT)))
+	}
+	if err := rows.Err(); err != nil {
+		return errors.Wrap(err, "failed to read pending issue reports"), ""
+	}
+
+	if count == 0 {
+		return nil, "Tidak ada laporan yang menunggu persetujuan."
+	}
+	return nil, fmt.Sprintf(`*%d laporan menunggu persetujuan*:
+
+%sBalas *setujui <nomor> [catatan]* atau *tolak <nomor> [catatan]*.`, count, sb.String())
+}
+
+// handleIssueAction applies an action to an issue report on behalf of an official and records it in the audit
+// trail. The reporter is told about the change, along with the note, by the issue status listener.
+func handleIssueAction(ctx context.Context, db *pgxpool.Pool, official Official, issueReportId int, action IssueAction, note string) (error, string) {
+	trx, err := db.Begin(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to begin transaction"), ""
+	}
+	defer func(trx pgx.Tx, ctx context.Context) {
+		err := trx.Rollback(ctx)
+		if err != nil && !errors.Is(err, pgx.ErrTxClosed) {
+			log.Error().Err(err).Msg("Failed to rollback transaction")
+		}
+	}(trx, ctx)
+
+	// approval_status and status can be NULL on reports made in the RWIS web app
+	var rt, oldValue *string
+	err = trx.QueryRow(ctx, `
+SELECT h.rt,
+       CASE WHEN $2 = 'status' THEN issue_report.status ELSE issue_report.approval_status END
+FROM issue_report
+JOIN resident r on issue_report.resident_id = r.resident_id
+LEFT JOIN household h on r.household_id = h.household_id
+WHERE issue_report_id = $1
+FOR UPDATE OF issue_report`, issueReportId, action.Column).Scan(&rt, &oldValue)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, fmt.Sprintf("Laporan *#%d* tidak ditemukan.", issueReportId)
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to get issue report"), ""
+	}
+	reporterRT := 0
+	if rt != nil {
+		reporterRT = parseRT(*rt)
+	}
+	if !official.CanManage(reporterRT) {
+		return nil, fmt.Sprintf("Anda tidak berwenang mengelola laporan *#%d*.", issueReportId)
+	}
+	if oldValue != nil && *oldValue == action.Value {
+		return nil, fmt.Sprintf("Laporan *#%d* sudah berstatus *%s*.", issueReportId, action.Value)
+	}
+
+	// the column comes from issueActions, never from the message
+	_, err = trx.Exec(ctx, `UPDATE issue_report SET `+action.Column+` = $2 WHERE issue_report_id = $1`, issueReportId, action.Value)
+	if err != nil {
+		return errors.Wrap(err, "failed to update issue report"), ""
+	}
+
+	_, err = trx.Exec(ctx, `INSERT INTO issue_report_audit (issue_report_id, official_number, field, old_value, new_value, note)
+VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''))`, issueReportId, official.WhatsappNumber, action.Column, oldValue, action.Value, note)
+	if err != nil {
+		return errors.Wrap(err, "failed to insert issue report audit"), ""
+	}
+
+	err = trx.Commit(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to commit issue report action"), ""
+	}
+
+	if oldValue == nil {
+		return nil, fmt.Sprintf("Laporan *#%d* telah diubah menjadi *%s*. Pelapor akan diberi tahu.", issueReportId, action.Value)
+	}
+	return nil, fmt.Sprintf("Laporan *#%d* telah diubah dari *%s* menjadi *%s*. Pelapor akan diberi tahu.", issueReportId, *oldValue, action.Value)
+}
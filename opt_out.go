@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// BroadcastCategory is a kind of broadcast residents can unsubscribe from, unless it is mandatory.
+type BroadcastCategory struct {
+	Name  string
+	Label string
+	// Mandatory broadcasts are sent to residents who opted out, such as emergencies.
+	Mandatory bool
+}
+
+// DefaultBroadcastCategory is the category of broadcasts submitted without one.
+const DefaultBroadcastCategory = "pengumuman"
+
+// BroadcastCategories are the categories a broadcast can be submitted in.
+var BroadcastCategories = []BroadcastCategory{
+	{Name: "pengumuman", Label: "Pengumuman umum"},
+	{Name: "kegiatan", Label: "Kegiatan warga"},
+	{Name: "iuran", Label: "Pengingat iuran"},
+	{Name: "darurat", Label: "Keadaan darurat", Mandatory: true},
+}
+
+// getBroadcastCategory returns the category with the given name, ignoring case.
+func getBroadcastCategory(name string) (BroadcastCategory, bool) {
+	for _, category := range BroadcastCategories {
+		if strings.EqualFold(category.Name, strings.TrimSpace(name)) {
+			return category, true
+		}
+	}
+	return BroadcastCategory{}, false
+}
+
+// optionalBroadcastCategories are the categories residents can unsubscribe from.
+func optionalBroadcastCategories() []BroadcastCategory {
+	var categories []BroadcastCategory
+	for _, category := range BroadcastCategories {
+		if !category.Mandatory {
+			categories = append(categories, category)
+		}
+	}
+	return categories
+}
+
+// optOutKeywords unsubscribe the resident, optionally followed by a category, e.g. "STOP kegiatan".
+var optOutKeywords = []string{"stop", "berhenti"}
+
+// optInKeywords subscribe the resident to every category again.
+var optInKeywords = []string{"mulai", "start"}
+
+// parseOptOutCommand splits an opt-out or opt-in message into its keyword and the rest of the message.
+func parseOptOutCommand(msg string, keywords []string) (string, bool) {
+	fields := strings.Fields(msg)
+	if len(fields) == 0 || len(fields) > 2 || !matchesKeyword(fields[0], keywords) {
+		return "", false
+	}
+	if len(fields) == 1 {
+		return "", true
+	}
+	return fields[1], true
+}
+
+// handleOptOutEvent lets residents unsubscribe from broadcasts by replying STOP or BERHENTI, and subscribe again with
+// MULAI. It returns false when the message is not an opt-out command.
+func (b *Bot) handleOptOutEvent(sender string, msg string, evt *events.Message) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	evt.Info.Sender.Device = 0
+
+	var err error
+	var reply string
+	if rest, ok := parseOptOutCommand(msg, optInKeywords); ok && rest == "" {
+		err, reply = handleOptIn(ctx, b.db, sender)
+	} else if name, ok := parseOptOutCommand(msg, optOutKeywords); ok {
+		if name == "" {
+			err = b.sendOptOutMenu(ctx, sender, evt)
+			if err != nil {
+				log.Error().Err(err).Msg("Failed to send opt-out menu")
+			}
+			return true
+		}
+		category, found := getBroadcastCategory(name)
+		if !found {
+			return false
+		}
+		err, reply = handleOptOut(ctx, b.db, sender, []BroadcastCategory{category})
+	} else {
+		return false
+	}
+
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to handle opt-out")
+	}
+	err = b.sendReply(ctx, evt, "opt_out", reply)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to send message")
+	}
+	return true
+}
+
+// sendOptOutMenu asks the resident which broadcasts they no longer want to receive.
+func (b *Bot) sendOptOutMenu(ctx context.Context, sender string, evt *events.Message) error {
+	optOut := func(categories ...BroadcastCategory) ConversationStep {
+		return func(ctx context.Context, sender string, msg string, evt *events.Message) (string, ConversationStep, error) {
+			err, reply := handleOptOut(ctx, b.db, sender, categories)
+			return reply, nil, err
+		}
+	}
+
+	optional := optionalBroadcastCategories()
+	var options []MenuOption
+	for _, category := range optional {
+		options = append(options, MenuOption{Label: category.Label, Handle: optOut(category)})
+	}
+	options = append(options, MenuOption{Label: "Semua pesan siaran", Handle: optOut(optional...)})
+
+	return b.sendMenu(ctx, evt, sender, "opt_out", Menu{
+		Title:   "*Berhenti berlangganan*\nPesan siaran mana yang tidak ingin Anda terima lagi?",
+		Options: options,
+	})
+}
+
+// handleOptOut unsubscribes the resident from the given broadcast categories.
+func handleOptOut(ctx context.Context, db *pgxpool.Pool, sender string, categories []BroadcastCategory) (error, string) {
+	var names, labels []string
+	for _, category := range categories {
+		if category.Mandatory {
+			continue
+		}
+		names = append(names, category.Name)
+		labels = append(labels, category.Label)
+	}
+	if len(names) == 0 {
+		return nil, "Pesan siaran ini wajib dan tidak dapat dihentikan."
+	}
+
+	_, err := db.Exec(ctx, `
+INSERT INTO broadcast_opt_out (whatsapp_number, category)
+SELECT $1, unnest($2::text[])
+ON CONFLICT DO NOTHING`, sender, names)
+	if err != nil {
+		return errors.Wrap(err, "failed to insert opt-out"), "Maaf, saya tidak bisa memproses permintaan Anda saat ini."
+	}
+
+	return nil, fmt.Sprintf("Anda tidak akan menerima pesan siaran *%s* lagi. "+
+		"Pesan keadaan darurat akan tetap dikirim.\n\nKetik *MULAI* untuk berlangganan kembali.",
+		strings.Join(labels, ", "))
+}
+
+// handleOptIn subscribes the resident to every broadcast category again.
+func handleOptIn(ctx context.Context, db *pgxpool.Pool, sender string) (error, string) {
+	_, err := db.Exec(ctx, `DELETE FROM broadcast_opt_out WHERE whatsapp_number = $1`, sender)
+	if err != nil {
+		return errors.Wrap(err, "failed to delete opt-out"), "Maaf, saya tidak bisa memproses permintaan Anda saat ini."
+	}
+	return nil, "Anda akan kembali menerima semua pesan siaran."
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	"google.golang.org/protobuf/proto"
+)
+
+// ErrQueuedForRetry is returned when a message could not be sent right away and was left in the outbox to be retried.
+var ErrQueuedForRetry = errors.New("message queued for retry")
+
+const (
+	OutboxStatusPending = "pending"
+	// OutboxStatusSending is a message claimed by a sender, hidden from the retry worker however long the dispatcher
+	// makes it wait.
+	OutboxStatusSending = "sending"
+	OutboxStatusSent    = "sent"
+	OutboxStatusFailed  = "failed"
+)
+
+const (
+	// outboxPollInterval is how often the retry worker looks for messages that are due.
+	outboxPollInterval = 5 * time.Second
+	// outboxRetention is how long sent and failed messages are kept. Only their metadata is, the content is dropped once
+	// they are settled, since replies can carry personal data.
+	outboxRetention = 30 * 24 * time.Hour
+)
+
+// Outbox records every outgoing message before it is sent, and retries the ones that fail with exponential backoff,
+// so a restart or a network blip never drops a message.
+type Outbox struct {
+	db         *pgxpool.Pool
+	client     *whatsmeow.Client
+	dispatcher *Dispatcher
+
+	maxAttempts int
+	baseBackoff time.Duration
+	maxBackoff  time.Duration
+}
+
+func NewOutbox(db *pgxpool.Pool, client *whatsmeow.Client, dispatcher *Dispatcher) *Outbox {
+	return &Outbox{
+		db:          db,
+		client:      client,
+		dispatcher:  dispatcher,
+		maxAttempts: envInt("OUTBOX_MAX_ATTEMPTS", 10),
+		baseBackoff: envDuration("OUTBOX_BASE_BACKOFF", 5*time.Second),
+		maxBackoff:  envDuration("OUTBOX_MAX_BACKOFF", time.Hour),
+	}
+}
+
+// OutboxMessage is a message waiting in the outbox.
+type OutboxMessage struct {
+	Id       int64
+	To       types.JID
+	Message  *waProto.Message
+	Attempts int
+	// BroadcastRecipientId links the message to the broadcast recipient whose status follows it, or is nil.
+	BroadcastRecipientId *int64
+}
+
+// Send records a message in the outbox and tries to send it right away. When sending fails the message stays in the
+// outbox and ErrQueuedForRetry is returned, wrapped with the reason. Broadcasts that can not be recorded are not sent,
+// and their recipient is marked as failed.
+func (o *Outbox) Send(ctx context.Context, to types.JID, message *waProto.Message, broadcastRecipientId *int64) (whatsmeow.SendResponse, error) {
+	id, err := o.insert(ctx, to, message, broadcastRecipientId, OutboxStatusSending)
+	if err != nil && broadcastRecipientId != nil {
+		// a broadcast sent without the outbox would leave its recipient pending and be sent again after a restart
+		recordErr := o.failRecipient(ctx, *broadcastRecipientId, err)
+		if recordErr != nil {
+			log.Error().Err(recordErr).Msgf("Failed to mark broadcast recipient %d as failed", *broadcastRecipientId)
+		}
+		return whatsmeow.SendResponse{}, err
+	}
+	if err != nil {
+		// without the outbox a reply can still be sent, it just won't be retried
+		log.Error().Err(err).Msg("Failed to record message in outbox")
+		return o.dispatcher.Send(ctx, to, message)
+	}
+	return o.attempt(ctx, OutboxMessage{
+		Id:                   id,
+		To:                   to,
+		Message:              message,
+		BroadcastRecipientId: broadcastRecipientId,
+	})
+}
+
+// Enqueue records a message in the outbox without sending it, leaving it to the retry worker.
+func (o *Outbox) Enqueue(ctx context.Context, to types.JID, message *waProto.Message) error {
+	_, err := o.insert(ctx, to, message, nil, OutboxStatusPending)
+	return err
+}
+
+func (o *Outbox) insert(ctx context.Context, to types.JID, message *waProto.Message, broadcastRecipientId *int64, status string) (int64, error) {
+	data, err := proto.Marshal(message)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to marshal message")
+	}
+
+	var id int64
+	err = o.db.QueryRow(ctx, `
+INSERT INTO outbox (recipient, message, status, broadcast_recipient_id)
+VALUES ($1, $2, $3, $4)
+RETURNING outbox_id`, to.String(), data, status, broadcastRecipientId).Scan(&id)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to insert outbox message")
+	}
+	return id, nil
+}
+
+// attempt sends an outbox message once and records the outcome.
+func (o *Outbox) attempt(ctx context.Context, message OutboxMessage) (whatsmeow.SendResponse, error) {
+	var response whatsmeow.SendResponse
+	var err error
+	if !o.client.IsConnected() {
+		err = whatsmeow.ErrNotConnected
+	} else if message.BroadcastRecipientId != nil {
+		// only broadcasts count towards the daily cap, replies to residents are always sent
+		response, err = o.dispatcher.SendBroadcast(ctx, message.To, message.Message)
+	} else {
+		response, err = o.dispatcher.Send(ctx, message.To, message.Message)
+	}
+
+	// record the outcome even if ctx is done, the message is in flight either way
+	recordCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err == nil {
+		recordErr := o.markSent(recordCtx, message, response)
+		if recordErr != nil {
+			log.Error().Err(recordErr).Msgf("Failed to mark outbox message %d as sent", message.Id)
+		}
+		return response, nil
+	}
+
+	attempts := message.Attempts + 1
+	if errors.Is(err, ErrDailyCapReached) {
+		// waiting for the cap to reset is not a failed attempt
+		attempts = message.Attempts
+	}
+	if attempts >= o.maxAttempts {
+		recordErr := o.markFailed(recordCtx, message, attempts, err)
+		if recordErr != nil {
+			log.Error().Err(recordErr).Msgf("Failed to mark outbox message %d as failed", message.Id)
+		}
+		return response, errors.Wrapf(err, "giving up after %d attempts", attempts)
+	}
+
+	recordErr := o.scheduleRetry(recordCtx, message, attempts, err)
+	if recordErr != nil {
+		log.Error().Err(recordErr).Msgf("Failed to schedule retry of outbox message %d", message.Id)
+	}
+	return response, errors.Wrap(ErrQueuedForRetry, err.Error())
+}
+
+// backoff returns the delay before the given attempt, doubling from the base backoff up to the max backoff.
+func (o *Outbox) backoff(attempts int) time.Duration {
+	delay := o.baseBackoff
+	for i := 1; i < attempts && delay < o.maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > o.maxBackoff {
+		delay = o.maxBackoff
+	}
+	return delay
+}
+
+// retryDelay returns how long to wait before retrying a message that failed with sendErr. Messages over the daily cap
+// are retried hourly until the cap resets.
+func (o *Outbox) retryDelay(attempts int, sendErr error) time.Duration {
+	if errors.Is(sendErr, ErrDailyCapReached) {
+		return time.Hour
+	}
+	return o.backoff(attempts)
+}
+
+func (o *Outbox) markSent(ctx context.Context, message OutboxMessage, response whatsmeow.SendResponse) error {
+	_, err := o.db.Exec(ctx, `
+UPDATE outbox
+SET status     = $2,
+    message    = '',
+    attempts   = attempts + 1,
+    message_id = $3,
+    sent_at    = $4,
+    last_error = NULL
+WHERE outbox_id = $1`, message.Id, OutboxStatusSent, response.ID, response.Timestamp)
+	if err != nil {
+		return errors.Wrap(err, "failed to update outbox message")
+	}
+	if message.BroadcastRecipientId == nil {
+		return nil
+	}
+	_, err = o.db.Exec(ctx, `
+UPDATE broadcast_recipient
+SET status     = $2,
+    message_id = $3,
+    sent_at    = $4,
+    error      = NULL
+WHERE broadcast_recipient_id = $1`, *message.BroadcastRecipientId, RecipientStatusSent, response.ID, response.Timestamp)
+	if err != nil {
+		return errors.Wrap(err, "failed to update broadcast recipient")
+	}
+	return nil
+}
+
+func (o *Outbox) markFailed(ctx context.Context, message OutboxMessage, attempts int, sendErr error) error {
+	_, err := o.db.Exec(ctx, `
+UPDATE outbox
+SET status     = $2,
+    message    = '',
+    attempts   = $3,
+    last_error = $4
+WHERE outbox_id = $1`, message.Id, OutboxStatusFailed, attempts, sendErr.Error())
+	if err != nil {
+		return errors.Wrap(err, "failed to update outbox message")
+	}
+	if message.BroadcastRecipientId == nil {
+		return nil
+	}
+	return o.failRecipient(ctx, *message.BroadcastRecipientId, sendErr)
+}
+
+func (o *Outbox) failRecipient(ctx context.Context, broadcastRecipientId int64, sendErr error) error {
+	_, err := o.db.Exec(ctx, `
+UPDATE broadcast_recipient
+SET status = $2,
+    error  = $3
+WHERE broadcast_recipient_id = $1`, broadcastRecipientId, RecipientStatusFailed, sendErr.Error())
+	if err != nil {
+		return errors.Wrap(err, "failed to update broadcast recipient")
+	}
+	return nil
+}
+
+func (o *Outbox) scheduleRetry(ctx context.Context, message OutboxMessage, attempts int, sendErr error) error {
+	_, err := o.db.Exec(ctx, `
+UPDATE outbox
+SET status          = $5,
+    attempts        = $2,
+    last_error      = $3,
+    next_attempt_at = $4
+WHERE outbox_id = $1`, message.Id, attempts, sendErr.Error(), time.Now().Add(o.retryDelay(attempts, sendErr)), OutboxStatusPending)
+	if err != nil {
+		return errors.Wrap(err, "failed to update outbox message")
+	}
+	if message.BroadcastRecipientId == nil {
+		return nil
+	}
+	// the recipient stays pending, the error tells why it is not sent yet
+	_, err = o.db.Exec(ctx, `
+UPDATE broadcast_recipient
+SET error = $2
+WHERE broadcast_recipient_id = $1`, *message.BroadcastRecipientId, sendErr.Error())
+	if err != nil {
+		return errors.Wrap(err, "failed to update broadcast recipient")
+	}
+	return nil
+}
+
+// ReleaseClaimed hands the messages still claimed back to the retry worker. They were being sent when the bot stopped
+// and whether they went out is unknown, so they are sent again rather than dropped. It must run before anything sends
+// through the outbox, or it would release messages that are being sent right now.
+func (o *Outbox) ReleaseClaimed(ctx context.Context) error {
+	_, err := o.db.Exec(ctx, `UPDATE outbox SET status = $2 WHERE status = $1`, OutboxStatusSending, OutboxStatusPending)
+	if err != nil {
+		return errors.Wrap(err, "failed to release claimed outbox messages")
+	}
+	return nil
+}
+
+// Run retries pending outbox messages until ctx is done. Messages to the same recipient are retried one at a time,
+// oldest first, so split replies keep their order.
+func (o *Outbox) Run(ctx context.Context) {
+	ticker := time.NewTicker(outboxPollInterval)
+	defer ticker.Stop()
+	lastCleanup := time.Time{}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if !o.client.IsConnected() {
+			continue
+		}
+
+		messages, err := o.due(ctx)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to get due outbox messages")
+			continue
+		}
+		for _, message := range messages {
+			_, err := o.attempt(ctx, message)
+			if err != nil {
+				log.Warn().Err(err).Msgf("Retry %d of outbox message %d failed", message.Attempts+1, message.Id)
+			}
+		}
+
+		if time.Since(lastCleanup) > time.Hour {
+			lastCleanup = time.Now()
+			_, err := o.db.Exec(ctx, `DELETE FROM outbox WHERE status IN ($1, $2) AND created_at < $3`, OutboxStatusSent, OutboxStatusFailed, time.Now().Add(-outboxRetention))
+			if err != nil {
+				log.Error().Err(err).Msg("Failed to clean up outbox")
+			}
+		}
+	}
+}
+
+// due claims the messages that are ready to be retried. Only the oldest unsent message of each recipient is retried,
+// and none while another message to the recipient is being sent.
+func (o *Outbox) due(ctx context.Context) ([]OutboxMessage, error) {
+	rows, err := o.db.Query(ctx, `
+UPDATE outbox
+SET status = $2
+WHERE outbox_id IN (SELECT outbox_id
+                    FROM (SELECT DISTINCT ON (recipient) outbox_id, status, next_attempt_at
+                          FROM outbox
+                          WHERE status IN ($1, $2)
+                          ORDER BY recipient, outbox_id) oldest
+                    WHERE status = $1
+                      AND next_attempt_at <= now()
+                    LIMIT 50)
+RETURNING outbox_id, recipient, message, attempts, broadcast_recipient_id`, OutboxStatusPending, OutboxStatusSending)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to lease outbox messages")
+	}
+	defer rows.Close()
+
+	var messages []OutboxMessage
+	for rows.Next() {
+		var message OutboxMessage
+		var recipient string
+		var data []byte
+		err := rows.Scan(&message.Id, &recipient, &data, &message.Attempts, &message.BroadcastRecipientId)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to scan outbox message")
+		}
+		// messages that can never be sent are failed right away, since they were claimed and would otherwise hold up
+		// every later message to the recipient
+		message.To, err = types.ParseJID(recipient)
+		if err != nil {
+			log.Error().Err(err).Msgf("Outbox message %d has an invalid recipient", message.Id)
+			o.fail(ctx, message, errors.Wrap(err, "invalid recipient"))
+			continue
+		}
+		message.Message = &waProto.Message{}
+		err = proto.Unmarshal(data, message.Message)
+		if err != nil {
+			log.Error().Err(err).Msgf("Outbox message %d can not be decoded", message.Id)
+			o.fail(ctx, message, errors.Wrap(err, "failed to decode message"))
+			continue
+		}
+		messages = append(messages, message)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to read outbox messages")
+	}
+	return messages, nil
+}
+
+// fail marks a claimed message that can not be sent as failed, logging when that fails too.
+func (o *Outbox) fail(ctx context.Context, message OutboxMessage, reason error) {
+	err := o.markFailed(ctx, message, message.Attempts, reason)
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed to mark outbox message %d as failed", message.Id)
+	}
+}
@@ -8,7 +8,7 @@ import (
 /**
 Output Types and Schemas
 
-1. Issue Report: { "type": "issue_report", "value": "string", "meta": { "title": "string", "description": "string" } }
+1. Issue Report: { "type": "issue_report", "value": "string", "meta": { "title": "string", "description": "string", "location": "string", "since": "string", "category": "string", "urgency": "string", "rt": number } }
 2. Chat: { "type": "chat", "value": "string" }
 3. Personal Data Request: { "type": "personal_data_request", "value": "string" }
 4. RW Data Request: { "type": "rw_data_request" }
@@ -18,6 +18,7 @@ Output Types and Schemas
 8. Broadcast Request: { "type": "broadcast_request" }
 9. RT Data Request: { "type": "rt_data_request", "name": "string", "fields": ["string"] }
 10. Reminder Request: { "type": "reminder_request", "before": "date", "pick": "string" }
+11. Issue Status Request: { "type": "issue_status_request", "ticket": number }
 */
 
 func parseGeminiAnswer(answer string) (error, map[string]interface{}) {
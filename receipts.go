@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// handleReceiptEvent records when broadcast messages are delivered to and read by their recipients. Read receipts
+// only arrive from residents who have not turned them off, so read rates are a lower bound.
+func (b *Bot) handleReceiptEvent(evt *events.Receipt) {
+	if evt.IsFromMe || evt.IsGroup {
+		return
+	}
+
+	var err error
+	switch evt.Type {
+	case types.ReceiptTypeDelivered:
+		err = recordBroadcastReceipt(b.db, evt.MessageIDs, evt.Timestamp, false)
+	case types.ReceiptTypeRead, types.ReceiptTypePlayed:
+		err = recordBroadcastReceipt(b.db, evt.MessageIDs, evt.Timestamp, true)
+	default:
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Msgf("Failed to record receipt of messages %v", evt.MessageIDs)
+	}
+}
+
+// recordBroadcastReceipt stores the time the messages were delivered or read, keeping the first time of each. A read
+// message counts as delivered too, since delivery receipts are not sent once a message has been read.
+func recordBroadcastReceipt(db *pgxpool.Pool, messageIds []types.MessageID, timestamp time.Time, read bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	ids := make([]string, len(messageIds))
+	for i, id := range messageIds {
+		ids[i] = string(id)
+	}
+
+	_, err := db.Exec(ctx, `
+UPDATE broadcast_recipient
+SET delivered_at = coalesce(delivered_at, $2),
+    read_at      = CASE WHEN $3 THEN coalesce(read_at, $2) ELSE read_at END
+WHERE message_id = ANY ($1)`, ids, timestamp, read)
+	if err != nil {
+		return errors.Wrap(err, "failed to update broadcast recipients")
+	}
+	return nil
+}
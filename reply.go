@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// DefaultReplyMaxLength is the default maximum length of a single outbound message, in characters.
+	DefaultReplyMaxLength = 1500
+	// DefaultReplyPartDelay is the default delay between consecutive parts of a split reply.
+	DefaultReplyPartDelay = 750 * time.Millisecond
+)
+
+// newReplyMessage builds the text message sent back to a resident. When quote is true the message carries a
+// ContextInfo pointing at the originating message, so WhatsApp renders the reply attached to the question it answers.
+func newReplyMessage(text string, evt *events.Message, quote bool) *waProto.Message {
+	extended := &waProto.ExtendedTextMessage{
+		Text: proto.String(text),
+	}
+	if quote && evt != nil && evt.Info.ID != "" {
+		extended.ContextInfo = &waProto.ContextInfo{
+			StanzaId:      proto.String(evt.Info.ID),
+			Participant:   proto.String(evt.Info.Sender.ToNonAD().String()),
+			QuotedMessage: evt.Message,
+		}
+	}
+	return &waProto.Message{ExtendedTextMessage: extended}
+}
+
+// shouldQuote reports whether replies for the given intent should quote the resident's message.
+// Quoting is on by default and can be turned off per intent with a comma separated list of intent types in
+// REPLY_QUOTE_DISABLED_INTENTS, for example "chat,ping".
+func shouldQuote(intent string) bool {
+	for _, disabled := range strings.Split(os.Getenv("REPLY_QUOTE_DISABLED_INTENTS"), ",") {
+		if disabled = strings.TrimSpace(disabled); disabled != "" && disabled == intent {
+			return false
+		}
+	}
+	return true
+}
+
+// replyMaxLength returns the maximum length of a single outbound message, configured with REPLY_MAX_LENGTH.
+func replyMaxLength() int {
+	maxLength, err := strconv.Atoi(os.Getenv("REPLY_MAX_LENGTH"))
+	if err != nil || maxLength <= 0 {
+		return DefaultReplyMaxLength
+	}
+	return maxLength
+}
+
+// replyPartDelay returns the delay between parts of a split reply, configured with REPLY_PART_DELAY (e.g. "1s").
+func replyPartDelay() time.Duration {
+	delay, err := time.ParseDuration(os.Getenv("REPLY_PART_DELAY"))
+	if err != nil || delay < 0 {
+		return DefaultReplyPartDelay
+	}
+	return delay
+}
+
+// splitReply splits a reply into parts no longer than maxLength characters. It prefers logical boundaries:
+// blocks separated by a blank line (one household member, one report) are kept together when they fit, then
+// single lines (one list item), and only a line that is longer than maxLength on its own is cut mid-text.
+func splitReply(text string, maxLength int) []string {
+	text = strings.TrimSpace(text)
+	if utf8.RuneCountInString(text) <= maxLength {
+		return []string{text}
+	}
+
+	var parts []string
+	var current strings.Builder
+	flush := func() {
+		if part := strings.TrimSpace(current.String()); part != "" {
+			parts = append(parts, part)
+		}
+		current.Reset()
+	}
+	appendChunk := func(chunk string, separator string) {
+		if current.Len() > 0 && utf8.RuneCountInString(current.String())+utf8.RuneCountInString(separator+chunk) > maxLength {
+			flush()
+		}
+		if current.Len() > 0 {
+			current.WriteString(separator)
+		}
+		current.WriteString(chunk)
+	}
+
+	for _, block := range strings.Split(text, "\n\n") {
+		block = strings.TrimSpace(block)
+		if block == "" {
+			continue
+		}
+		if utf8.RuneCountInString(block) <= maxLength {
+			appendChunk(block, "\n\n")
+			continue
+		}
+
+		// the block alone is too long, fall back to packing it line by line
+		flush()
+		for _, line := range strings.Split(block, "\n") {
+			for _, piece := range splitRunes(line, maxLength) {
+				appendChunk(piece, "\n")
+			}
+		}
+		flush()
+	}
+	flush()
+
+	return parts
+}
+
+// splitRunes cuts s into pieces of at most n runes.
+func splitRunes(s string, n int) []string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return []string{s}
+	}
+	var pieces []string
+	for len(runes) > n {
+		pieces = append(pieces, string(runes[:n]))
+		runes = runes[n:]
+	}
+	return append(pieces, string(runes))
+}
+
+// sendReply sends reply to the sender of evt, split into several messages when it is too long. Only the first part
+// quotes the resident's message.
+func (b *Bot) sendReply(ctx context.Context, evt *events.Message, intent string, reply string) error {
+	var quoted *events.Message
+	if shouldQuote(intent) {
+		quoted = evt
+	}
+	// replies to group messages go to the group, not to the member who sent them
+	to := evt.Info.Sender
+	if evt.Info.IsGroup {
+		to = evt.Info.Chat
+	}
+	return b.sendSplit(ctx, to, reply, quoted)
+}
+
+// sendText sends a message to a whatsapp number outside of a conversation, e.g. for notifications. Long messages are
+// split the same way as replies.
+func (b *Bot) sendText(ctx context.Context, number string, text string) error {
+	return b.sendSplit(ctx, types.NewJID(number, types.DefaultUserServer), text, nil)
+}
+
+// sendSplit sends text to jid as one or more messages no longer than the configured maximum length. Parts are sent
+// in order with a small delay between them. When quoted is not nil, the first part quotes that message.
+func (b *Bot) sendSplit(ctx context.Context, jid types.JID, text string, quoted *events.Message) error {
+	parts := splitReply(text, replyMaxLength())
+	for i, part := range parts {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return errors.Wrap(ctx.Err(), "message cancelled before all parts were sent")
+			case <-time.After(replyPartDelay()):
+			}
+		}
+
+		message, err := b.outbox.Send(ctx, jid, newReplyMessage(part, quoted, i == 0 && quoted != nil), nil)
+		if errors.Is(err, ErrQueuedForRetry) {
+			// leave the remaining parts to the outbox too, so they are sent after this one
+			for _, rest := range parts[i+1:] {
+				enqueueErr := b.outbox.Enqueue(ctx, jid, newReplyMessage(rest, nil, false))
+				if enqueueErr != nil {
+					return errors.Wrapf(enqueueErr, "failed to queue message parts after part %d of %d", i+1, len(parts))
+				}
+			}
+			return errors.Wrapf(err, "message part %d of %d", i+1, len(parts))
+		}
+		if err != nil {
+			return errors.Wrapf(err, "failed to send message part %d of %d", i+1, len(parts))
+		}
+		log.Debug().Msgf("Sent message %+v", message)
+	}
+	return nil
+}
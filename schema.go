@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/pkg/errors"
+)
+
+// migrations are the schema changes the gateway needs on top of the RWIS database. Every statement must be
+// idempotent, since all of them are run each time the bot starts.
+var migrations = []string{
+	// notify the gateway whenever an admin changes the status of an issue report from the RWIS web app
+	`CREATE OR REPLACE FUNCTION notify_issue_report_status() RETURNS trigger AS $$
+BEGIN
+    PERFORM pg_notify('issue_report_status', json_build_object(
+        'issue_report_id', NEW.issue_report_id,
+        'status', NEW.status,
+        'old_status', OLD.status,
+        'approval_status', NEW.approval_status,
+        'old_approval_status', OLD.approval_status,
+        'changed_at', now()
+    )::text);
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql`,
+	`DROP TRIGGER IF EXISTS issue_report_status_notify ON issue_report`,
+	`CREATE TRIGGER issue_report_status_notify
+    AFTER UPDATE OF status, approval_status
+    ON issue_report
+    FOR EACH ROW
+    WHEN (OLD.status IS DISTINCT FROM NEW.status OR OLD.approval_status IS DISTINCT FROM NEW.approval_status)
+EXECUTE FUNCTION notify_issue_report_status()`,
+	// photos and location pins residents attach to their issue reports
+	`ALTER TABLE issue_report
+    ADD COLUMN IF NOT EXISTS latitude double precision,
+    ADD COLUMN IF NOT EXISTS longitude double precision`,
+	`CREATE TABLE IF NOT EXISTS issue_report_attachment
+(
+    issue_report_attachment_id serial PRIMARY KEY,
+    issue_report_id            int         NOT NULL REFERENCES issue_report (issue_report_id) ON DELETE CASCADE,
+    path                       text        NOT NULL,
+    mime_type                  text        NOT NULL,
+    created_at                 timestamptz NOT NULL DEFAULT now()
+)`,
+	// triage fields classified by gemini, see IssueCategories and IssueUrgencies
+	`ALTER TABLE issue_report
+    ADD COLUMN IF NOT EXISTS category text,
+    ADD COLUMN IF NOT EXISTS urgency text,
+    ADD COLUMN IF NOT EXISTS affected_rt int`,
+	// residents supporting an open report instead of filing a duplicate of it
+	`ALTER TABLE issue_report
+    ADD COLUMN IF NOT EXISTS created_at timestamptz`,
+	// reports filed before the column existed keep a NULL creation time, so they are never offered as duplicates
+	`ALTER TABLE issue_report
+    ALTER COLUMN created_at SET DEFAULT now()`,
+	`CREATE TABLE IF NOT EXISTS issue_report_supporter
+(
+    issue_report_id int         NOT NULL REFERENCES issue_report (issue_report_id) ON DELETE CASCADE,
+    resident_id     int         NOT NULL REFERENCES resident (resident_id) ON DELETE CASCADE,
+    created_at      timestamptz NOT NULL DEFAULT now(),
+    PRIMARY KEY (issue_report_id, resident_id)
+)`,
+	// RT and RW officials notified about new reports and allowed to act on them from whatsapp
+	`CREATE TABLE IF NOT EXISTS official
+(
+    whatsapp_number text PRIMARY KEY,
+    name            text        NOT NULL,
+    role            text        NOT NULL CHECK (role IN ('rt', 'rw')),
+    rt              int,
+    created_at      timestamptz NOT NULL DEFAULT now()
+)`,
+	// every change officials make to issue reports from whatsapp. The status listener finds the note of a change by its
+	// field and value, in the first entry created no earlier than the notification.
+	`CREATE TABLE IF NOT EXISTS issue_report_audit
+(
+    issue_report_audit_id serial PRIMARY KEY,
+    issue_report_id       int         NOT NULL REFERENCES issue_report (issue_report_id) ON DELETE CASCADE,
+    official_number       text        NOT NULL,
+    field                 text        NOT NULL,
+    old_value             text,
+    new_value             text        NOT NULL,
+    note                  text,
+    created_at            timestamptz NOT NULL DEFAULT now()
+)`,
+	// ratings reporters give once their issue is done
+	`CREATE TABLE IF NOT EXISTS issue_report_rating
+(
+    issue_report_id int         PRIMARY KEY REFERENCES issue_report (issue_report_id) ON DELETE CASCADE,
+    resident_id     int         NOT NULL REFERENCES resident (resident_id) ON DELETE CASCADE,
+    rating          int         NOT NULL CHECK (rating BETWEEN 1 AND 5),
+    created_at      timestamptz NOT NULL DEFAULT now()
+)`,
+	// broadcasts submitted through the API and their delivery status per recipient
+	`CREATE TABLE IF NOT EXISTS broadcast_job
+(
+    broadcast_job_id bigserial PRIMARY KEY,
+    message          text        NOT NULL,
+    status           text        NOT NULL,
+    created_at       timestamptz NOT NULL DEFAULT now(),
+    finished_at      timestamptz
+)`,
+	`CREATE TABLE IF NOT EXISTS broadcast_recipient
+(
+    broadcast_recipient_id bigserial PRIMARY KEY,
+    broadcast_job_id       bigint NOT NULL REFERENCES broadcast_job (broadcast_job_id) ON DELETE CASCADE,
+    whatsapp_number        text   NOT NULL,
+    status                 text   NOT NULL,
+    message_id             text,
+    error                  text,
+    sent_at                timestamptz,
+    UNIQUE (broadcast_job_id, whatsapp_number)
+)`,
+	// broadcasts scheduled for a later time
+	`ALTER TABLE broadcast_job
+    ADD COLUMN IF NOT EXISTS send_at timestamptz`,
+	// when broadcasts reach their recipients, from whatsapp receipts
+	`ALTER TABLE broadcast_recipient
+    ADD COLUMN IF NOT EXISTS delivered_at timestamptz,
+    ADD COLUMN IF NOT EXISTS read_at timestamptz`,
+	`CREATE INDEX IF NOT EXISTS broadcast_recipient_message_id_idx ON broadcast_recipient (message_id)`,
+	// images and documents sent with broadcasts, kept until the job finishes or is cancelled
+	`ALTER TABLE broadcast_job
+    ADD COLUMN IF NOT EXISTS media bytea,
+    ADD COLUMN IF NOT EXISTS media_file_name text,
+    ADD COLUMN IF NOT EXISTS media_mime_type text`,
+	// broadcast categories residents unsubscribed from
+	`ALTER TABLE broadcast_job
+    ADD COLUMN IF NOT EXISTS category text NOT NULL DEFAULT 'pengumuman'`,
+	`CREATE TABLE IF NOT EXISTS broadcast_opt_out
+(
+    whatsapp_number text        NOT NULL,
+    category        text        NOT NULL,
+    created_at      timestamptz NOT NULL DEFAULT now(),
+    PRIMARY KEY (whatsapp_number, category)
+)`,
+	// responses to broadcast requests made with an Idempotency-Key header
+	`CREATE TABLE IF NOT EXISTS idempotency_key
+(
+    key          text PRIMARY KEY,
+    request_hash text        NOT NULL,
+    status       int         NOT NULL,
+    body         bytea,
+    created_at   timestamptz NOT NULL DEFAULT now()
+)`,
+	// keys clients of the API authenticate with, stored hashed
+	`CREATE TABLE IF NOT EXISTS api_key
+(
+    api_key_id serial PRIMARY KEY,
+    name       text        NOT NULL,
+    lookup     text        NOT NULL,
+    key_hash   text        NOT NULL,
+    scopes     text[]      NOT NULL,
+    expires_at timestamptz,
+    revoked_at timestamptz,
+    created_at timestamptz NOT NULL DEFAULT now()
+)`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS api_key_active_name_idx ON api_key (name) WHERE revoked_at IS NULL`,
+	`CREATE INDEX IF NOT EXISTS api_key_lookup_idx ON api_key (lookup)`,
+	// every outgoing message, kept until it is sent so it can be retried after failures and restarts
+	`CREATE TABLE IF NOT EXISTS outbox
+(
+    outbox_id              bigserial PRIMARY KEY,
+    recipient              text        NOT NULL,
+    message                bytea       NOT NULL,
+    status                 text        NOT NULL,
+    attempts               int         NOT NULL DEFAULT 0,
+    next_attempt_at        timestamptz NOT NULL DEFAULT now(),
+    last_error             text,
+    message_id             text,
+    sent_at                timestamptz,
+    broadcast_recipient_id bigint REFERENCES broadcast_recipient (broadcast_recipient_id) ON DELETE CASCADE,
+    created_at             timestamptz NOT NULL DEFAULT now()
+)`,
+	`CREATE INDEX IF NOT EXISTS outbox_unsent_idx ON outbox (recipient, outbox_id) WHERE status IN ('pending', 'sending')`,
+}
+
+// migrate applies the gateway's schema changes to the database.
+func migrate(ctx context.Context, db *pgxpool.Pool) error {
+	for i, migration := range migrations {
+		_, err := db.Exec(ctx, migration)
+		if err != nil {
+			return errors.Wrapf(err, "failed to run migration %d", i+1)
+		}
+	}
+	return nil
+}
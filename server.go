@@ -1,43 +1,48 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"github.com/go-chi/chi"
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
 	waProto "go.mau.fi/whatsmeow/binary/proto"
 	"go.mau.fi/whatsmeow/types"
 	"google.golang.org/protobuf/proto"
+	"io"
 	"net/http"
-	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type Server struct {
-	bot    *Bot
-	server *chi.Mux
-	token  string
+	bot         *Bot
+	broadcaster *Broadcaster
+	server      *chi.Mux
 }
 
 func (s *Server) Start() error {
 	s.server = chi.NewRouter()
-	s.server.Post("/api/v1/broadcast", s.handleBroadcast)
-
-	s.token = os.Getenv("BROADCAST_TOKEN")
-	if s.token == "" {
-		return errors.New("BROADCAST_TOKEN is not set")
-	}
+	s.server.Post("/api/v1/broadcast", s.authorize(ScopeBroadcast, s.idempotent(s.handleBroadcast)))
+	s.server.Get("/api/v1/broadcast/scheduled", s.authorize(ScopeReadStatus, s.handleScheduledBroadcasts))
+	s.server.Get("/api/v1/broadcast/{id}", s.authorize(ScopeReadStatus, s.handleBroadcastStatus))
+	s.server.Post("/api/v1/broadcast/{id}/cancel", s.authorize(ScopeBroadcast, s.handleBroadcastCancel))
+	s.server.Get("/api/v1/reports/satisfaction", s.authorize(ScopeReadStatus, s.handleSatisfactionReport))
 
 	return http.ListenAndServe(":8080", s.server)
 }
 
 func (s *Server) handleBroadcast(res http.ResponseWriter, req *http.Request) {
-	// make sure the request has the token to prevent abuse
-	if req.Header.Get("Authorization") != "Bearer "+s.token {
-		res.WriteHeader(http.StatusUnauthorized)
+	log.Debug().Msg("Received broadcast request")
+
+	// JSON requests carry a list of recipients and are sent in the background, as do multipart requests uploading
+	// a file along with the JSON request
+	if strings.HasPrefix(req.Header.Get("Content-Type"), "application/json") || isMultipartBroadcast(req) {
+		s.handleBroadcastJob(res, req)
 		return
 	}
 
-	log.Debug().Msg("Received broadcast request")
-
 	// get the message from the request body
 	message := req.FormValue("message")
 	// list of numbers to send the message to
@@ -49,11 +54,17 @@ func (s *Server) handleBroadcast(res http.ResponseWriter, req *http.Request) {
 	log.Debug().Msgf("Broadcasting message to number: %s", number)
 
 	// send the message to the numbers
-	_, err := s.bot.client.SendMessage(req.Context(), types.JID{User: number, Server: "s.whatsapp.net"}, &waProto.Message{
+	_, err := s.bot.outbox.Send(req.Context(), types.JID{User: number, Server: "s.whatsapp.net"}, &waProto.Message{
 		ExtendedTextMessage: &waProto.ExtendedTextMessage{
 			Text: proto.String(message),
 		},
-	})
+	}, nil)
+	if errors.Is(err, ErrQueuedForRetry) {
+		// the message will still be sent, so the client must not send it again
+		log.Warn().Err(err).Msg("Message queued for retry")
+		res.WriteHeader(http.StatusAccepted)
+		return
+	}
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to send message")
 		res.WriteHeader(http.StatusInternalServerError)
@@ -62,3 +73,282 @@ func (s *Server) handleBroadcast(res http.ResponseWriter, req *http.Request) {
 	log.Debug().Msg("Broadcast message sent")
 	res.WriteHeader(http.StatusOK)
 }
+
+// handleBroadcastJob queues a broadcast to a list of recipients and responds with the id of the job right away.
+// The delivery status can then be followed with GET /api/v1/broadcast/{id}.
+func (s *Server) handleBroadcastJob(res http.ResponseWriter, req *http.Request) {
+	request, err := decodeBroadcastRequest(req)
+	if err != nil {
+		writeError(res, http.StatusBadRequest, err)
+		return
+	}
+	err = request.ResolveAudience(req.Context(), s.bot.db)
+	if err != nil {
+		// invalid filters are the client's fault, failing queries are ours
+		if request.Audience.Validate() != nil {
+			writeError(res, http.StatusBadRequest, err)
+			return
+		}
+		log.Error().Err(err).Msg("Failed to resolve broadcast audience")
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if request.DryRun {
+		recipients, err := normalizeRecipients(request.Recipients)
+		if err != nil {
+			writeError(res, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(res, http.StatusOK, map[string]interface{}{
+			"dry_run":        true,
+			"recipients":     len(recipients),
+			"max_recipients": MaxBroadcastRecipients,
+			"exceeds_limit":  len(recipients) > MaxBroadcastRecipients,
+			"skipped":        request.Skipped,
+		})
+		return
+	}
+
+	err = request.Validate()
+	if err != nil {
+		writeError(res, http.StatusBadRequest, err)
+		return
+	}
+	if request.Media != nil {
+		err = request.Media.Load(req.Context())
+		if err != nil {
+			writeError(res, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	jobId, err := s.broadcaster.Enqueue(req.Context(), request)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to queue broadcast")
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	markIdempotentStored(req)
+	log.Debug().Msgf("Queued broadcast job %d to %d recipients, skipped %d", jobId, len(request.Recipients), len(request.Skipped))
+
+	writeJSON(res, http.StatusAccepted, map[string]interface{}{
+		"id":         jobId,
+		"status":     request.Status(),
+		"send_at":    request.SendAt,
+		"recipients": len(request.Recipients),
+		"skipped":    request.Skipped,
+	})
+}
+
+// isMultipartBroadcast reports whether the request is a multipart broadcast job, rather than a legacy form post.
+func isMultipartBroadcast(req *http.Request) bool {
+	if !strings.HasPrefix(req.Header.Get("Content-Type"), "multipart/form-data") {
+		return false
+	}
+	err := req.ParseMultipartForm(MaxBroadcastMediaSize)
+	return err == nil && req.MultipartForm.Value["request"] != nil
+}
+
+// decodeBroadcastRequest reads a broadcast request from a JSON body, or from a multipart form with the JSON in the
+// "request" field and an optional "file" to send with it.
+func decodeBroadcastRequest(req *http.Request) (BroadcastRequest, error) {
+	var request BroadcastRequest
+	if req.MultipartForm == nil {
+		err := json.NewDecoder(req.Body).Decode(&request)
+		if err != nil {
+			return request, errors.Wrap(err, "invalid request body")
+		}
+		return request, nil
+	}
+
+	err := json.Unmarshal([]byte(req.FormValue("request")), &request)
+	if err != nil {
+		return request, errors.Wrap(err, "invalid request field")
+	}
+
+	file, header, err := req.FormFile("file")
+	if errors.Is(err, http.ErrMissingFile) {
+		return request, nil
+	}
+	if err != nil {
+		return request, errors.Wrap(err, "invalid file")
+	}
+	defer file.Close()
+	if header.Size > MaxBroadcastMediaSize {
+		return request, errors.Errorf("media must not be larger than %d MB", MaxBroadcastMediaSize>>20)
+	}
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return request, errors.Wrap(err, "failed to read file")
+	}
+	request.Media = &BroadcastMedia{
+		FileName: header.Filename,
+		MimeType: header.Header.Get("Content-Type"),
+		Data:     data,
+	}
+	return request, nil
+}
+
+func (s *Server) handleScheduledBroadcasts(res http.ResponseWriter, req *http.Request) {
+	jobs, err := s.broadcaster.Scheduled(req.Context())
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get scheduled broadcast jobs")
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if jobs == nil {
+		jobs = []ScheduledBroadcast{}
+	}
+
+	writeJSON(res, http.StatusOK, jobs)
+}
+
+// handleBroadcastCancel cancels a scheduled broadcast. Broadcasts that are already being sent can not be cancelled.
+func (s *Server) handleBroadcastCancel(res http.ResponseWriter, req *http.Request) {
+	jobId, err := strconv.ParseInt(chi.URLParam(req, "id"), 10, 64)
+	if err != nil {
+		writeError(res, http.StatusBadRequest, errors.New("invalid broadcast id"))
+		return
+	}
+
+	cancelled, err := s.broadcaster.Cancel(req.Context(), jobId)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to cancel broadcast job")
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !cancelled {
+		job, err := s.broadcaster.Get(req.Context(), jobId)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to get broadcast job")
+			res.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if job == nil {
+			res.WriteHeader(http.StatusNotFound)
+			return
+		}
+		writeError(res, http.StatusConflict, errors.Errorf("broadcast job is %s and can no longer be cancelled", job.Status))
+		return
+	}
+	log.Debug().Msgf("Cancelled broadcast job %d", jobId)
+
+	writeJSON(res, http.StatusOK, map[string]interface{}{
+		"id":     jobId,
+		"status": BroadcastStatusCancelled,
+	})
+}
+
+func (s *Server) handleBroadcastStatus(res http.ResponseWriter, req *http.Request) {
+	jobId, err := strconv.ParseInt(chi.URLParam(req, "id"), 10, 64)
+	if err != nil {
+		writeError(res, http.StatusBadRequest, errors.New("invalid broadcast id"))
+		return
+	}
+
+	job, err := s.broadcaster.Get(req.Context(), jobId)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get broadcast job")
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if job == nil {
+		res.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	writeJSON(res, http.StatusOK, job)
+}
+
+func (s *Server) handleSatisfactionReport(res http.ResponseWriter, req *http.Request) {
+	days, err := strconv.Atoi(req.URL.Query().Get("days"))
+	if err != nil || days <= 0 {
+		days = 30
+	}
+
+	summaries, err := getSatisfactionSummary(req.Context(), s.bot.db, days)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get satisfaction summary")
+		res.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(res, http.StatusOK, summaries)
+}
+
+// apiKeyContextKey is the context key of the API key a request was made with.
+type apiKeyContextKey struct{}
+
+// requestApiKey returns the API key the request was authorized with.
+func requestApiKey(req *http.Request) *ApiKey {
+	apiKey, _ := req.Context().Value(apiKeyContextKey{}).(*ApiKey)
+	return apiKey
+}
+
+// authorize lets requests through to next only with an active API key granting the scope, and logs every request
+// with the name of its key.
+func (s *Server) authorize(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: res, status: http.StatusOK}
+		keyName := ""
+		defer func() {
+			log.Info().
+				Str("api_key", keyName).
+				Str("method", req.Method).
+				Str("path", req.URL.Path).
+				Int("status", recorder.status).
+				Dur("duration", time.Since(start)).
+				Msg("API request")
+		}()
+
+		key, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			recorder.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		apiKey, err := authenticateApiKey(req.Context(), s.bot.db, key)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to authenticate api key")
+			recorder.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if apiKey == nil {
+			recorder.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		keyName = apiKey.Name
+		if !apiKey.Allows(scope) {
+			writeError(recorder, http.StatusForbidden, errors.Errorf("api key does not have the %s scope", scope))
+			return
+		}
+
+		next(recorder, req.WithContext(context.WithValue(req.Context(), apiKeyContextKey{}, apiKey)))
+	}
+}
+
+// statusRecorder remembers the status written to the client, for logging.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func writeJSON(res http.ResponseWriter, status int, body interface{}) {
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	err := json.NewEncoder(res).Encode(body)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to encode response")
+	}
+}
+
+func writeError(res http.ResponseWriter, status int, err error) {
+	writeJSON(res, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// Transcriber turns voice notes into text.
+type Transcriber interface {
+	Transcribe(ctx context.Context, mimeType string, audio []byte) (string, error)
+}
+
+// GeminiTranscriber transcribes voice notes with gemini's audio input.
+type GeminiTranscriber struct{}
+
+func (t GeminiTranscriber) Transcribe(_ context.Context, mimeType string, audio []byte) (string, error) {
+	inlineData, err := newInlineData(mimeType, audio)
+	if err != nil {
+		return "", errors.Wrap(err, "voice note can not be sent to gemini")
+	}
+
+	transcript, err := sendGeminiRequest(VisionBaseUrl, GeminiRequest{
+		Contents: []Content{{
+			Role: "user",
+			Parts: []Part{
+				{Text: "Transkripsikan pesan suara berikut apa adanya dalam bahasa aslinya. Balas hanya dengan teks transkripnya."},
+				{InlineData: &inlineData},
+			},
+		}},
+		GenerationConfig: GenerationConfig{
+			MaxOutputTokens: 512,
+		},
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "failed to transcribe voice note")
+	}
+	return strings.TrimSpace(transcript), nil
+}
+
+// StubTranscriber is a Transcriber that returns a fixed transcript, for local development and tests without gemini.
+type StubTranscriber struct {
+	Transcript string
+}
+
+func (t StubTranscriber) Transcribe(context.Context, string, []byte) (string, error) {
+	return t.Transcript, nil
+}
+
+// NewTranscriber returns the transcriber selected with TRANSCRIBER, either "gemini" (the default) or "stub".
+// The stub answers every voice note with STUB_TRANSCRIPT.
+func NewTranscriber() Transcriber {
+	if os.Getenv("TRANSCRIBER") == "stub" {
+		return StubTranscriber{Transcript: os.Getenv("STUB_TRANSCRIPT")}
+	}
+	return GeminiTranscriber{}
+}
+
+// sideEffectIntents are the intents that change data. When they are triggered by a voice note, the transcript is
+// echoed back so the resident can check what the bot heard before confirming.
+var sideEffectIntents = map[string]bool{
+	"issue_report": true,
+}
+
+// transcribeVoiceNote downloads the voice note of evt and returns its transcript.
+func (b *Bot) transcribeVoiceNote(ctx context.Context, evt *events.Message) (string, error) {
+	audio := evt.Message.GetAudioMessage()
+	data, err := b.downloadMedia(audio)
+	if err != nil {
+		return "", err
+	}
+	transcript, err := b.transcriber.Transcribe(ctx, audio.GetMimetype(), data)
+	if err != nil {
+		return "", err
+	}
+	if transcript == "" {
+		return "", errors.New("voice note transcript is empty")
+	}
+	log.Debug().Msgf("Transcribed voice note %s: %s", evt.Info.ID, transcript)
+	return transcript, nil
+}
+
+// echoTranscript prefixes reply with the transcript of the voice note the resident sent.
+func echoTranscript(transcript string, reply string) string {
+	return "*Pesan suara Anda*: _" + transcript + "_\n\n" + reply
+}